@@ -0,0 +1,65 @@
+package badger
+
+import (
+	"context"
+	"time"
+)
+
+// Compact forces a compaction of the LSM tree until all tables are on a
+// single level, dropping deleted and overwritten keys, using the given number
+// of concurrent compactors. Writes keep working but compete with the
+// compaction, so it is best run when the datastore is mostly idle, e.g. after
+// a mass deletion.
+//
+// Badger can't interrupt a compaction once it has started: cancelling ctx
+// makes Compact return early, but the compaction carries on in the background
+// and Close waits for it to finish.
+func (d *Datastore) Compact(ctx context.Context, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	d.closeLk.RLock()
+	if d.closed {
+		d.closeLk.RUnlock()
+		return ErrClosed
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer d.closeLk.RUnlock()
+
+		// Flattening concurrently makes badger stop and restart its
+		// compactors out of order.
+		d.compactLk.Lock()
+		defer d.compactLk.Unlock()
+
+		log.Infow("compacting LSM tree", "workers", workers)
+		start := time.Now()
+		err := d.DB.Flatten(workers)
+		log.Infow("finished compacting LSM tree", "duration", time.Since(start), "err", err)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// compactOnClose compacts the LSM tree before closing, warning if it takes
+// longer than timeout.
+func (d *Datastore) compactOnClose(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch err := d.Compact(ctx, 1); err {
+	case nil, ErrClosed:
+	case context.DeadlineExceeded:
+		log.Warnf("compaction on close did not finish within %s, waiting for the running compaction", timeout)
+	default:
+		log.Errorf("failed to compact on close: %s", err)
+	}
+}
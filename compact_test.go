@@ -0,0 +1,78 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestCompact(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := d.Put(bg, ds.NewKey(fmt.Sprintf("/key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+	if err := d.Compact(ctx, 2); err != context.Canceled && err != nil {
+		t.Fatalf("expected compaction to finish or be cancelled, got %v", err)
+	}
+
+	if err := d.Compact(bg, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	has, err := d.Has(bg, ds.NewKey("/key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Fatal("key lost during compaction")
+	}
+
+	d.Close()
+	if err := d.Compact(bg, 1); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCompactOnClose(t *testing.T) {
+	path := t.TempDir()
+	opts := DefaultOptions
+	opts.CompactOnCloseTimeout = time.Minute
+	d, err := NewDatastore(path, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addTestCases(t, d, testcases)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDatastore(path, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for k, v := range testcases {
+		got, err := d.Get(bg, ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v {
+			t.Fatalf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package badger
+
+import (
+	"context"
+	"sync"
+)
+
+// GCCoordinator limits the number of GC rounds running at the same time
+// across all the datastores sharing it, e.g. several datastores opened by
+// the same process on the same disk. See Options.GcCoordinator.
+//
+// When rounds have to wait, the datastore with the highest GcPriority goes
+// first. Datastores with the same priority take turns.
+type GCCoordinator struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiting []*gcWaiter
+
+	// grants counts the rounds started, to order datastores by when they
+	// last ran.
+	grants uint64
+}
+
+// gcMember is a datastore registered with a GCCoordinator.
+type gcMember struct {
+	c        *GCCoordinator
+	priority int
+
+	// lastGrant is the value of c.grants when this member last started a
+	// round. Protected by c.mu.
+	lastGrant uint64
+}
+
+type gcWaiter struct {
+	m     *gcMember
+	ready chan struct{}
+}
+
+// NewGCCoordinator creates a GCCoordinator allowing at most maxConcurrent GC
+// rounds at the same time. maxConcurrent is raised to 1 if lower.
+func NewGCCoordinator(maxConcurrent int) *GCCoordinator {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &GCCoordinator{limit: maxConcurrent}
+}
+
+func (c *GCCoordinator) join(priority int) *gcMember {
+	return &gcMember{c: c, priority: priority}
+}
+
+// acquire waits for a GC slot to become available. On success, the caller
+// must call release once its round is over.
+func (m *gcMember) acquire(ctx context.Context, closing <-chan struct{}) error {
+	c := m.c
+	c.mu.Lock()
+	if c.running < c.limit && len(c.waiting) == 0 {
+		c.grant(m)
+		c.mu.Unlock()
+		return nil
+	}
+	w := &gcWaiter{m: m, ready: make(chan struct{})}
+	c.waiting = append(c.waiting, w)
+	c.mu.Unlock()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-closing:
+		err = ErrClosed
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.waiting {
+		if other == w {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			return err
+		}
+	}
+	// We were granted a slot while giving up, hand it over.
+	c.running--
+	c.next()
+	return err
+}
+
+func (m *gcMember) release() {
+	c := m.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	c.next()
+}
+
+// grant starts a round for m. c.mu must be held.
+func (c *GCCoordinator) grant(m *gcMember) {
+	c.running++
+	c.grants++
+	m.lastGrant = c.grants
+}
+
+// next hands free slots over to the waiting datastores with the highest
+// priority, least recently served first. c.mu must be held.
+func (c *GCCoordinator) next() {
+	for c.running < c.limit && len(c.waiting) > 0 {
+		best := 0
+		for i, w := range c.waiting[1:] {
+			b := c.waiting[best]
+			if w.m.priority > b.m.priority ||
+				(w.m.priority == b.m.priority && w.m.lastGrant < b.m.lastGrant) {
+				best = i + 1
+			}
+		}
+		w := c.waiting[best]
+		c.waiting = append(c.waiting[:best], c.waiting[best+1:]...)
+		c.grant(w.m)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,189 @@
+package badger
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acquireAsync starts acquiring a slot for m and returns a channel closed once
+// it got one.
+func acquireAsync(t *testing.T, m *gcMember) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		if err := m.acquire(bg, nil); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	return done
+}
+
+// waitForWaiters waits until n members are queued in c.
+func waitForWaiters(t *testing.T, c *GCCoordinator, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiting)
+		c.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d waiters", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectGranted(t *testing.T, granted <-chan struct{}, name string) {
+	t.Helper()
+	select {
+	case <-granted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s wasn't granted a slot", name)
+	}
+}
+
+func expectWaiting(t *testing.T, granted <-chan struct{}, name string) {
+	t.Helper()
+	select {
+	case <-granted:
+		t.Fatalf("%s was granted a slot out of turn", name)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestGCCoordinatorPriority(t *testing.T) {
+	c := NewGCCoordinator(1)
+	holder := c.join(0)
+	low := c.join(0)
+	high := c.join(5)
+
+	if err := holder.acquire(bg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	lowGranted := acquireAsync(t, low)
+	waitForWaiters(t, c, 1)
+	highGranted := acquireAsync(t, high)
+	waitForWaiters(t, c, 2)
+
+	holder.release()
+	expectGranted(t, highGranted, "high priority")
+	expectWaiting(t, lowGranted, "low priority")
+
+	high.release()
+	expectGranted(t, lowGranted, "low priority")
+	low.release()
+}
+
+func TestGCCoordinatorRoundRobin(t *testing.T) {
+	c := NewGCCoordinator(1)
+	a := c.join(0)
+	b := c.join(0)
+
+	// b ran more recently than a.
+	for _, m := range []*gcMember{a, b} {
+		if err := m.acquire(bg, nil); err != nil {
+			t.Fatal(err)
+		}
+		m.release()
+	}
+
+	holder := c.join(0)
+	if err := holder.acquire(bg, nil); err != nil {
+		t.Fatal(err)
+	}
+	bGranted := acquireAsync(t, b)
+	waitForWaiters(t, c, 1)
+	aGranted := acquireAsync(t, a)
+	waitForWaiters(t, c, 2)
+
+	holder.release()
+	expectGranted(t, aGranted, "least recently served")
+	expectWaiting(t, bGranted, "most recently served")
+	a.release()
+	expectGranted(t, bGranted, "most recently served")
+	b.release()
+}
+
+func TestGCCoordinatorCancel(t *testing.T) {
+	c := NewGCCoordinator(1)
+	holder := c.join(0)
+	waiter := c.join(0)
+
+	if err := holder.acquire(bg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(bg, 10*time.Millisecond)
+	defer cancel()
+	if err := waiter.acquire(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	closing := make(chan struct{})
+	close(closing)
+	if err := waiter.acquire(bg, closing); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	holder.release()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running != 0 || len(c.waiting) != 0 {
+		t.Fatalf("expected an idle coordinator, got %d running and %d waiting", c.running, len(c.waiting))
+	}
+}
+
+func TestSharedGCCoordinator(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+
+	c := NewGCCoordinator(1)
+	var stores []*Datastore
+	for i := 0; i < 3; i++ {
+		opts := DefaultOptions
+		opts.GcInterval = 0
+		opts.GcCoordinator = c
+		d, err := NewDatastore(t.TempDir(), &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		stores = append(stores, d)
+	}
+
+	// Track concurrency from inside the coordinator's critical section:
+	// a round holds its slot until OnGC returns.
+	var wg sync.WaitGroup
+	for _, d := range stores {
+		d.onGC = func(GCRound) {
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}
+		wg.Add(1)
+		go func(d *Datastore) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if err := d.CollectGarbage(bg); err != nil {
+					t.Error(err)
+				}
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Fatalf("expected at most one concurrent GC round, got %d", maxRunning)
+	}
+}
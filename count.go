@@ -0,0 +1,92 @@
+package badger
+
+import (
+	"context"
+	"sync"
+
+	badger "github.com/dgraph-io/badger"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// countQuery is the query Count evaluates filters for: values are loaded
+// when needed and expirations are provided.
+var countQuery = dsq.Query{ReturnExpirations: true}
+
+// countCheckInterval is the number of keys counted between context checks.
+const countCheckInterval = 1024
+
+// Count returns the number of keys under prefix matching all the filters,
+// and the total size of their values.
+//
+// Unlike a KeysOnly query, it doesn't send every key over a channel.
+// Values are only read if some filters can't be evaluated on the key and
+// its value size. The work is split across Options.ScanWorkers goroutines.
+func (d *Datastore) Count(ctx context.Context, prefix string, filters []dsq.Filter) (count int, size int64, err error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return 0, 0, ErrClosed
+	}
+
+	txn := d.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	p := queryPrefix(prefix)
+	keys, rest := queryRange(p, filters)
+	f := splitFilters(rest)
+	if keys.empty() {
+		return 0, 0, nil
+	}
+	ranges := []keyRange{keys}
+	if d.scanWorkers > 1 {
+		ranges = d.splitRange(p, keys)
+	}
+	if len(ranges) == 1 {
+		return countRange(ctx, txn, p, ranges[0], f)
+	}
+
+	var lk sync.Mutex
+	err = parallelScan(ctx, ranges, d.scanWorkers, func(ctx context.Context, r keyRange) error {
+		n, s, err := countRange(ctx, txn, p, r, f)
+		lk.Lock()
+		count += n
+		size += s
+		lk.Unlock()
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+// countRange counts the keys in r matching the filters.
+func countRange(ctx context.Context, txn *badger.Txn, prefix []byte, r keyRange, filters queryFilters) (count int, size int64, err error) {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.Prefix = prefix
+	it := newRangeIterator(txn, opt, r)
+	defer it.it.Close()
+
+	it.rewind()
+	for seen := 0; it.valid(); it.next() {
+		if seen%countCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, 0, err
+			}
+		}
+		seen++
+
+		item := it.item()
+		matches, err := matchItem(item, countQuery, filters, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !matches {
+			continue
+		}
+		count++
+		size += item.ValueSize()
+	}
+	return count, size, nil
+}
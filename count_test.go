@@ -0,0 +1,68 @@
+package badger
+
+import (
+	"context"
+	"testing"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestCount(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	for _, tc := range []struct {
+		name    string
+		prefix  string
+		filters []dsq.Filter
+		count   int
+		size    int64
+	}{
+		{name: "all", prefix: "/", count: 9, size: 17},
+		{name: "prefix", prefix: "/a", count: 5, size: 14},
+		{name: "key filter", prefix: "/a", filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/b/"}}, count: 2, size: 8},
+		{name: "value filter", prefix: "/", filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("ac")}}, count: 1, size: 2},
+		{name: "none", prefix: "/z", count: 0, size: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			count, size, err := d.Count(bg, tc.prefix, tc.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tc.count || size != tc.size {
+				t.Fatalf("expected %d keys and %d bytes, got %d and %d", tc.count, tc.size, count, size)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+	if _, _, err := d.Count(ctx, "/", nil); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCountParallel(t *testing.T) {
+	d, value := newParallelTestDatastore(t, 5000)
+
+	n, size, err := d.Count(bg, "/scan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5000 || size != 5000*int64(len(value)) {
+		t.Fatalf("expected 5000 keys, got %d (%d bytes)", n, size)
+	}
+
+	n, _, err = d.Count(bg, "/scan", []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThanOrEqual, Key: "/scan/04000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("expected 1000 keys, got %d", n)
+	}
+}
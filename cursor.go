@@ -0,0 +1,153 @@
+package badger
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// ErrInvalidCursor is returned when resuming from a malformed cursor,
+	// or from a cursor obtained with a different query.
+	ErrInvalidCursor = errors.New("invalid query cursor")
+
+	// ErrCursorOrder is returned when paging through a query not ordered
+	// by key.
+	ErrCursorOrder = errors.New("query cursors require results ordered by key")
+)
+
+// PagedResults are the results of QueryFrom. On top of the usual Results,
+// they provide cursors to resume the query after a given entry.
+type PagedResults struct {
+	dsq.Results
+
+	fingerprint uint64
+
+	lk   sync.Mutex
+	last string
+}
+
+// NextSync returns the next result, see dsq.Results.
+func (r *PagedResults) NextSync() (dsq.Result, bool) {
+	res, ok := r.Results.NextSync()
+	if ok && res.Error == nil {
+		r.setLast(res.Key)
+	}
+	return res, ok
+}
+
+// Rest returns all the remaining entries, see dsq.Results.
+func (r *PagedResults) Rest() ([]dsq.Entry, error) {
+	es, err := r.Results.Rest()
+	if len(es) > 0 {
+		r.setLast(es[len(es)-1].Key)
+	}
+	return es, err
+}
+
+func (r *PagedResults) setLast(key string) {
+	r.lk.Lock()
+	r.last = key
+	r.lk.Unlock()
+}
+
+// Cursor returns a cursor resuming the query after the last entry returned
+// by NextSync or Rest, or the cursor the query started from if there is
+// none. Entries read from the Next channel aren't tracked, use CursorAfter
+// for those.
+func (r *PagedResults) Cursor() string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.CursorAfter(r.last)
+}
+
+// CursorAfter returns a cursor resuming the query after the given key.
+func (r *PagedResults) CursorAfter(key string) string {
+	if key == "" {
+		return ""
+	}
+	buf := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(buf, r.fingerprint)
+	buf = append(buf, key...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// QueryFrom runs a query ordered by key, resuming after the entry the
+// cursor was obtained for. An empty cursor starts from the beginning.
+//
+// Resuming seeks straight to the next key, so paging through a large
+// prefix with a Limit costs the same for every page, unlike Offset. The
+// query must be the same on every page, except for Offset, which is only
+// applied to the first one, and Limit.
+func (d *Datastore) QueryFrom(ctx context.Context, q dsq.Query, cursor string) (*PagedResults, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	reverse, ok := keyOrder(q)
+	if !ok {
+		return nil, ErrCursorOrder
+	}
+
+	r := &PagedResults{fingerprint: queryFingerprint(q)}
+	baseQuery := q
+	if cursor != "" {
+		after, err := r.parseCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		r.last = after
+
+		// Resume right after the last key, the range filter is turned
+		// into a seek.
+		op := dsq.GreaterThan
+		if reverse {
+			op = dsq.LessThan
+		}
+		baseQuery.Filters = append(q.Filters[:len(q.Filters):len(q.Filters)], dsq.FilterKeyCompare{Op: op, Key: after})
+		baseQuery.Offset = 0
+	}
+
+	txn := d.newImplicitTransaction(true)
+	res, err := txn.query(baseQuery, d.queryLimits(ctx))
+	if err != nil {
+		return nil, err
+	}
+	r.Results = dsq.ResultsReplaceQuery(res, q)
+	return r, nil
+}
+
+// parseCursor returns the key a cursor resumes after.
+func (r *PagedResults) parseCursor(cursor string) (string, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) <= 8 {
+		return "", ErrInvalidCursor
+	}
+	if binary.BigEndian.Uint64(buf) != r.fingerprint {
+		return "", ErrInvalidCursor
+	}
+	return string(buf[8:]), nil
+}
+
+// queryFingerprint identifies the results of a query, ignoring Offset and
+// Limit, so that cursors can't be used to resume a different query.
+func queryFingerprint(q dsq.Query) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00", ds.NewKey(q.Prefix))
+	for _, f := range q.Filters {
+		fmt.Fprintf(h, "%T %v\x00", f, f)
+	}
+	for _, o := range q.Orders {
+		fmt.Fprintf(h, "%T %v\x00", o, o)
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,122 @@
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestQueryFrom(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var keys []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("/page/%02d", i)
+		keys = append(keys, key)
+		if err := d.Put(bg, ds.NewKey(key), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(bg, ds.NewKey("/other"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reversed := make([]string, len(keys))
+	for i, k := range keys {
+		reversed[len(keys)-1-i] = k
+	}
+
+	for _, tc := range []struct {
+		name   string
+		q      dsq.Query
+		expect []string
+	}{{
+		name:   "ascending",
+		q:      dsq.Query{Prefix: "/page", Limit: 10},
+		expect: keys,
+	}, {
+		name:   "descending",
+		q:      dsq.Query{Prefix: "/page", Limit: 10, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+		expect: reversed,
+	}, {
+		name: "offset and filters",
+		q: dsq.Query{
+			Prefix:  "/page",
+			Limit:   4,
+			Offset:  2,
+			Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.LessThan, Value: []byte{20}}},
+		},
+		expect: keys[2:20],
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > len(keys) {
+					t.Fatal("paging doesn't end")
+				}
+				res, err := d.QueryFrom(bg, tc.q, cursor)
+				if err != nil {
+					t.Fatal(err)
+				}
+				es, err := res.Rest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range es {
+					got = append(got, e.Key)
+				}
+				if len(es) < tc.q.Limit {
+					break
+				}
+				cursor = res.Cursor()
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expect) {
+				t.Fatalf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+
+	q := dsq.Query{Prefix: "/page", Limit: 3}
+	res, err := d.QueryFrom(bg, q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Cursor() != "" {
+		t.Fatal("expected no cursor before reading any entry")
+	}
+	if r, ok := res.NextSync(); !ok || r.Key != keys[0] {
+		t.Fatalf("unexpected first result %v", r)
+	}
+	cursor := res.Cursor()
+	res.Close()
+	if cursor != res.CursorAfter(keys[0]) {
+		t.Fatal("expected the cursor to point after the first key")
+	}
+
+	res, err = d.QueryFrom(bg, q, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Cursor() != cursor {
+		t.Fatal("expected the cursor to be kept until an entry is read")
+	}
+	expectKeys(t, keys[1:4], res)
+
+	// Cursors only resume the query they were obtained for.
+	if _, err := d.QueryFrom(bg, dsq.Query{Prefix: "/other"}, cursor); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := d.QueryFrom(bg, q, "not a cursor"); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := d.QueryFrom(bg, dsq.Query{Orders: []dsq.Order{dsq.OrderByValue{}}}, ""); err != ErrCursorOrder {
+		t.Fatalf("expected ErrCursorOrder, got %v", err)
+	}
+}
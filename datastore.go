@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	badger "github.com/dgraph-io/badger"
@@ -34,16 +35,48 @@ var ErrClosed = errors.New("datastore closed")
 type Datastore struct {
 	DB *badger.DB
 
+	path string
+
 	closeLk   sync.RWMutex
 	closed    bool
 	closeOnce sync.Once
 	closing   chan struct{}
 
-	gcDiscardRatio float64
-	gcSleep        time.Duration
-	gcInterval     time.Duration
+	gcLk     sync.Mutex
+	gcOpts   GCOptions
+	gcPaused bool
+	// gcWake tells the periodic GC that its options changed.
+	gcWake chan struct{}
+
+	// Bytes written and deleted since the last GC cycle, only tracked when
+	// GC is driven by write volume.
+	churn      atomic.Int64
+	trackChurn atomic.Bool
+
+	gcStatsLk    sync.Mutex
+	gcStats      GCStats
+	gcHistoryPos int
+	onGC         func(GCRound)
+	gcMember     *gcMember
+
+	compactLk             sync.Mutex
+	compactOnCloseTimeout time.Duration
 
 	syncWrites bool
+
+	// Value log settings, needed to estimate garbage like badger's GC.
+	valueThreshold int
+	vlogMaxEntries uint32
+
+	scanWorkers int
+	sortMemory  int64
+
+	defaultQueryLimits QueryLimits
+
+	indexLk sync.RWMutex
+	indexes map[string]Index
+
+	expirationIndex bool
 }
 
 // Implements the datastore.Batch interface, enabling batching support for
@@ -51,6 +84,12 @@ type Datastore struct {
 type batch struct {
 	ds         *Datastore
 	writeBatch *badger.WriteBatch
+
+	// Bytes written and deleted by this batch, see Datastore.addChurn.
+	churn int64
+
+	// Writes to indexed keys, applied in transactions on commit.
+	indexOps []indexOp
 }
 
 // Implements the datastore.Txn interface, enabling transaction support for
@@ -62,6 +101,9 @@ type txn struct {
 	// Whether this transaction has been implicitly created as a result of a direct Datastore
 	// method invocation.
 	implicit bool
+
+	// Bytes written and deleted by this transaction, see Datastore.addChurn.
+	churn int64
 }
 
 // Options are the badger datastore options, reexported here for convenience.
@@ -71,7 +113,8 @@ type Options struct {
 
 	// Interval between GC cycles
 	//
-	// If zero, the datastore will perform no automatic garbage collection.
+	// If zero, the datastore will perform no automatic garbage collection
+	// until an interval is set with SetGCOptions.
 	GcInterval time.Duration
 
 	// Sleep time between rounds of a single GC cycle.
@@ -80,9 +123,123 @@ type Options struct {
 	// GcInterval.
 	GcSleep time.Duration
 
+	// Number of bytes written or deleted after which a GC cycle is started.
+	//
+	// If this or GcGrowthRatio is set, GC cycles are driven by write volume
+	// and GcInterval is ignored.
+	GcChurnThreshold int64
+
+	// Growth of the value log, as a fraction of its size after the previous
+	// GC cycle, after which a GC cycle is started. Value logs smaller than
+	// 1MiB grow as a fraction of 1MiB, so that GC also starts on a new
+	// datastore.
+	GcGrowthRatio float64
+
+	// Bounds on the time between write-driven GC cycles. Write volume is
+	// checked every GcMinInterval (one minute if zero) and, if
+	// GcMaxInterval is non-zero, a cycle is started at least that often
+	// regardless of write volume.
+	GcMinInterval time.Duration
+	GcMaxInterval time.Duration
+
+	// Fraction of the filesystem holding the datastore that must be kept
+	// free. Below it, GC runs immediately, lowering the discard ratio after
+	// every cycle that doesn't free enough, down to GcMinDiscardRatio.
+	// Rounds of these cycles are GcSleep apart.
+	//
+	// If zero, free disk space is not monitored.
+	GcDiskFreeThreshold float64
+
+	// Interval between free disk space checks, 10 seconds if zero.
+	GcDiskCheckInterval time.Duration
+
+	// Lowest discard ratio GC escalates to, 0.01 if zero.
+	GcMinDiscardRatio float64
+
+	// Disk usage, in bytes, the datastore should be brought down to by GC.
+	// While above it, a GC cycle or CollectGarbage call that finds nothing
+	// to collect retries with half the discard ratio, down to
+	// GcMinDiscardRatio.
+	//
+	// If zero, every cycle only uses GcDiscardRatio.
+	GcTargetSize int64
+
+	// Maintenance windows the periodic GC is restricted to, see
+	// ParseGCSchedule. Cycles falling outside of a window are deferred
+	// until the next one opens.
+	//
+	// If nil, GC may run at any time.
+	GcSchedule GCSchedule
+
+	// Run GC to completion, or until the window closes, when a maintenance
+	// window opens with a deferred cycle instead of running a single
+	// cycle.
+	GcCollectOnWindowOpen bool
+
+	// Coordinator shared with other datastores to limit how many GC rounds
+	// run at once across all of them, see NewGCCoordinator.
+	//
+	// If nil, GC rounds of this datastore never wait for other datastores.
+	GcCoordinator *GCCoordinator
+
+	// Priority of this datastore's GC rounds in GcCoordinator. Higher
+	// priority datastores go first.
+	GcPriority int
+
+	// Called after every GC round, whatever triggered it. It is called from
+	// the goroutine running the GC and delays the next round until it
+	// returns.
+	OnGC func(GCRound)
+
+	// Compact the LSM tree (see Datastore.Compact) when closing, expecting
+	// it to take at most this long. Badger can't abort a compaction, so if
+	// it takes longer Close logs a warning and keeps waiting for it.
+	//
+	// If zero, the datastore isn't compacted on close.
+	CompactOnCloseTimeout time.Duration
+
+	// Number of goroutines Count and QueryParallel split their work
+	// between, using the key ranges of the LSM tree tables.
+	//
+	// If zero or one, scans run on a single goroutine.
+	ScanWorkers int
+
+	// Memory, in bytes, used to sort query results ordered by something
+	// else than their key. Results that don't fit are sorted in temporary
+	// files under the datastore directory.
+	//
+	// If zero, 64MiB are used.
+	QuerySortMemory int64
+
+	// Default limits of queries, see WithQueryLimits to override them.
+	QueryLimits QueryLimits
+
+	// Maintain an index of the keys written with a TTL, ordered by
+	// expiration, for QueryExpiring. Writes then read the previous
+	// expiration of the keys they overwrite, to remove it from the index.
+	ExpirationIndex bool
+
 	badger.Options
 }
 
+func (o *Options) gcOptions() GCOptions {
+	return GCOptions{
+		DiscardRatio:   o.GcDiscardRatio,
+		Interval:       o.GcInterval,
+		Sleep:          o.GcSleep,
+		ChurnThreshold: o.GcChurnThreshold,
+		GrowthRatio:    o.GcGrowthRatio,
+		MinInterval:    o.GcMinInterval,
+		MaxInterval:    o.GcMaxInterval,
+
+		MinDiscardRatio: o.GcMinDiscardRatio,
+		TargetSize:      o.GcTargetSize,
+
+		Schedule:            o.GcSchedule,
+		CollectOnWindowOpen: o.GcCollectOnWindowOpen,
+	}
+}
+
 // DefaultOptions are the default options for the badger datastore.
 var DefaultOptions Options
 
@@ -131,31 +288,49 @@ var _ ds.Batching = (*Datastore)(nil)
 func NewDatastore(path string, opts *Options) (*Datastore, error) {
 	// Copy the options because we modify them.
 	var opt badger.Options
-	var gcDiscardRatio float64
-	var gcSleep time.Duration
-	var gcInterval time.Duration
+	var gcOpts GCOptions
+	var diskFreeThreshold float64
+	var diskCheckInterval time.Duration
+	var compactOnCloseTimeout time.Duration
+	var onGC func(GCRound)
+	var gcCoordinator *GCCoordinator
+	var gcPriority int
+	var scanWorkers int
+	var sortMemory int64
+	var queryLimits QueryLimits
+	var expirationIndex bool
 	if opts == nil {
 		opt = badger.DefaultOptions("")
-		gcDiscardRatio = DefaultOptions.GcDiscardRatio
-		gcSleep = DefaultOptions.GcSleep
-		gcInterval = DefaultOptions.GcInterval
+		gcOpts = DefaultOptions.gcOptions()
+		diskFreeThreshold = DefaultOptions.GcDiskFreeThreshold
+		diskCheckInterval = DefaultOptions.GcDiskCheckInterval
+		compactOnCloseTimeout = DefaultOptions.CompactOnCloseTimeout
+		onGC = DefaultOptions.OnGC
+		gcCoordinator = DefaultOptions.GcCoordinator
+		gcPriority = DefaultOptions.GcPriority
+		scanWorkers = DefaultOptions.ScanWorkers
+		sortMemory = DefaultOptions.QuerySortMemory
+		queryLimits = DefaultOptions.QueryLimits
+		expirationIndex = DefaultOptions.ExpirationIndex
 	} else {
 		opt = opts.Options
-		gcDiscardRatio = opts.GcDiscardRatio
-		gcSleep = opts.GcSleep
-		gcInterval = opts.GcInterval
+		gcOpts = opts.gcOptions()
+		diskFreeThreshold = opts.GcDiskFreeThreshold
+		diskCheckInterval = opts.GcDiskCheckInterval
+		compactOnCloseTimeout = opts.CompactOnCloseTimeout
+		onGC = opts.OnGC
+		gcCoordinator = opts.GcCoordinator
+		gcPriority = opts.GcPriority
+		scanWorkers = opts.ScanWorkers
+		sortMemory = opts.QuerySortMemory
+		queryLimits = opts.QueryLimits
+		expirationIndex = opts.ExpirationIndex
 	}
 
 	if os.Getenv("GOARCH") == "386" {
 		opt.TableLoadingMode = options.FileIO
 	}
 
-	if gcSleep <= 0 {
-		// If gcSleep is 0, we don't perform multiple rounds of GC per
-		// cycle.
-		gcSleep = gcInterval
-	}
-
 	opt.Dir = path
 	opt.ValueDir = path
 	opt.Logger = &badgerLog{*log}
@@ -167,53 +342,49 @@ func NewDatastore(path string, opts *Options) (*Datastore, error) {
 		}
 		return nil, err
 	}
+	// Now that badger holds the directory lock, nobody else can be using
+	// sort files left behind.
+	removeSortFiles(path)
 
-	ds := &Datastore{
-		DB:             kv,
-		closing:        make(chan struct{}),
-		gcDiscardRatio: gcDiscardRatio,
-		gcSleep:        gcSleep,
-		gcInterval:     gcInterval,
-		syncWrites:     opt.SyncWrites,
+	if sortMemory <= 0 {
+		sortMemory = defaultSortMemory
 	}
 
-	// Start the GC process if requested.
-	if ds.gcInterval > 0 {
-		go ds.periodicGC()
+	ds := &Datastore{
+		DB:                    kv,
+		path:                  path,
+		closing:               make(chan struct{}),
+		gcOpts:                gcOpts,
+		gcWake:                make(chan struct{}, 1),
+		onGC:                  onGC,
+		compactOnCloseTimeout: compactOnCloseTimeout,
+		syncWrites:            opt.SyncWrites,
+		valueThreshold:        opt.ValueThreshold,
+		vlogMaxEntries:        opt.ValueLogMaxEntries,
+		scanWorkers:           max(scanWorkers, 1),
+		sortMemory:            sortMemory,
+		defaultQueryLimits:    queryLimits,
+		expirationIndex:       expirationIndex,
+	}
+	ds.trackChurn.Store(ds.gcOpts.adaptive())
+	if gcCoordinator != nil {
+		ds.gcMember = gcCoordinator.join(gcPriority)
+	}
+
+	// Start the GC process. It stays idle until it's given an interval, so
+	// it can be enabled later with SetGCOptions.
+	go ds.periodicGC()
+
+	if diskFreeThreshold > 0 {
+		if diskCheckInterval <= 0 {
+			diskCheckInterval = defaultGcDiskCheckInterval
+		}
+		go ds.watchDiskPressure(diskFreeThreshold, diskCheckInterval)
 	}
 
 	return ds, nil
 }
 
-// Keep scheduling GC's AFTER `gcInterval` has passed since the previous GC
-func (d *Datastore) periodicGC() {
-	gcTimeout := time.NewTimer(d.gcInterval)
-	defer gcTimeout.Stop()
-
-	for {
-		select {
-		case <-gcTimeout.C:
-			switch err := d.gcOnce(); err {
-			case badger.ErrNoRewrite, badger.ErrRejected:
-				// No rewrite means we've fully garbage collected.
-				// Rejected means someone else is running a GC
-				// or we're closing.
-				gcTimeout.Reset(d.gcInterval)
-			case nil:
-				gcTimeout.Reset(d.gcSleep)
-			case ErrClosed:
-				return
-			default:
-				log.Errorf("error during a GC cycle: %s", err)
-				// Not much we can do on a random error but log it and continue.
-				gcTimeout.Reset(d.gcInterval)
-			}
-		case <-d.closing:
-			return
-		}
-	}
-}
-
 // NewTransaction starts a new transaction. The resulting transaction object
 // can be mutated without incurring changes to the underlying Datastore until
 // the transaction is Committed.
@@ -224,13 +395,13 @@ func (d *Datastore) NewTransaction(ctx context.Context, readOnly bool) (ds.Txn,
 		return nil, ErrClosed
 	}
 
-	return &txn{d, d.DB.NewTransaction(!readOnly), false}, nil
+	return &txn{ds: d, txn: d.DB.NewTransaction(!readOnly)}, nil
 }
 
 // newImplicitTransaction creates a transaction marked as 'implicit'.
 // Implicit transactions are created by Datastore methods performing single operations.
 func (d *Datastore) newImplicitTransaction(readOnly bool) *txn {
-	return &txn{d, d.DB.NewTransaction(!readOnly), true}
+	return &txn{ds: d, txn: d.DB.NewTransaction(!readOnly), implicit: true}
 }
 
 func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
@@ -240,14 +411,25 @@ func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
 		return ErrClosed
 	}
 
-	txn := d.newImplicitTransaction(false)
-	defer txn.discard()
+	return d.update(func(txn *txn) error {
+		return txn.put(key, value)
+	})
+}
 
-	if err := txn.put(key, value); err != nil {
-		return err
+// update runs fn in an implicit transaction and commits it, retrying on
+// conflicts, see RegisterIndex.
+func (d *Datastore) update(fn func(txn *txn) error) error {
+	for {
+		txn := d.newImplicitTransaction(false)
+		err := fn(txn)
+		if err == nil {
+			err = txn.commit()
+		}
+		txn.discard()
+		if err != badger.ErrConflict {
+			return err
+		}
 	}
-
-	return txn.commit()
 }
 
 func (d *Datastore) Sync(ctx context.Context, prefix ds.Key) error {
@@ -271,14 +453,9 @@ func (d *Datastore) PutWithTTL(ctx context.Context, key ds.Key, value []byte, tt
 		return ErrClosed
 	}
 
-	txn := d.newImplicitTransaction(false)
-	defer txn.discard()
-
-	if err := txn.putWithTTL(key, value, ttl); err != nil {
-		return err
-	}
-
-	return txn.commit()
+	return d.update(func(txn *txn) error {
+		return txn.putWithTTL(key, value, ttl)
+	})
 }
 
 func (d *Datastore) SetTTL(ctx context.Context, key ds.Key, ttl time.Duration) error {
@@ -354,15 +531,9 @@ func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
 	d.closeLk.RLock()
 	defer d.closeLk.RUnlock()
 
-	txn := d.newImplicitTransaction(false)
-	defer txn.discard()
-
-	err := txn.delete(key)
-	if err != nil {
-		return err
-	}
-
-	return txn.commit()
+	return d.update(func(txn *txn) error {
+		return txn.delete(key)
+	})
 }
 
 func (d *Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
@@ -376,7 +547,7 @@ func (d *Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error)
 	// We cannot defer txn.Discard() here, as the txn must remain active while the iterator is open.
 	// https://github.com/dgraph-io/badger/commit/b1ad1e93e483bbfef123793ceedc9a7e34b09f79
 	// The closing logic in the query goprocess takes care of discarding the implicit transaction.
-	return txn.query(q)
+	return txn.query(q, d.queryLimits(ctx))
 }
 
 // DiskUsage implements the PersistentDatastore interface.
@@ -394,6 +565,9 @@ func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
 func (d *Datastore) Close() error {
 	d.closeOnce.Do(func() {
 		close(d.closing)
+		if d.compactOnCloseTimeout > 0 {
+			d.compactOnClose(d.compactOnCloseTimeout)
+		}
 	})
 	d.closeLk.Lock()
 	defer d.closeLk.Unlock()
@@ -413,7 +587,7 @@ func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
 		return nil, ErrClosed
 	}
 
-	b := &batch{d, d.DB.NewWriteBatch()}
+	b := &batch{ds: d, writeBatch: d.DB.NewWriteBatch()}
 	// Ensure that incomplete transaction resources are cleaned up in case
 	// batch is abandoned.
 	runtime.SetFinalizer(b, func(b *batch) {
@@ -424,31 +598,6 @@ func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
 	return b, nil
 }
 
-func (d *Datastore) CollectGarbage(ctx context.Context) (err error) {
-	// The idea is to keep calling DB.RunValueLogGC() till Badger no longer has any log files
-	// to GC(which would be indicated by an error, please refer to Badger GC docs).
-	for err == nil {
-		err = d.gcOnce()
-	}
-
-	if err == badger.ErrNoRewrite {
-		err = nil
-	}
-
-	return err
-}
-
-func (d *Datastore) gcOnce() error {
-	d.closeLk.RLock()
-	defer d.closeLk.RUnlock()
-	if d.closed {
-		return ErrClosed
-	}
-	log.Info("Running GC round")
-	defer log.Info("Finished running GC round")
-	return d.DB.RunValueLogGC(d.gcDiscardRatio)
-}
-
 var _ ds.Batch = (*batch)(nil)
 
 func (b *batch) Put(ctx context.Context, key ds.Key, value []byte) error {
@@ -461,7 +610,16 @@ func (b *batch) Put(ctx context.Context, key ds.Key, value []byte) error {
 }
 
 func (b *batch) put(key ds.Key, value []byte) error {
-	return b.writeBatch.Set(key.Bytes(), value)
+	if len(b.ds.indexesFor(key)) > 0 {
+		b.indexOps = append(b.indexOps, indexOp{key: key, value: value})
+		return nil
+	}
+	k := key.Bytes()
+	if err := b.writeBatch.Set(k, value); err != nil {
+		return err
+	}
+	b.churn += int64(len(k) + len(value))
+	return nil
 }
 
 func (b *batch) Delete(ctx context.Context, key ds.Key) error {
@@ -475,7 +633,18 @@ func (b *batch) Delete(ctx context.Context, key ds.Key) error {
 }
 
 func (b *batch) delete(key ds.Key) error {
-	return b.writeBatch.Delete(key.Bytes())
+	if len(b.ds.indexesFor(key)) > 0 {
+		b.indexOps = append(b.indexOps, indexOp{key: key, delete: true})
+		return nil
+	}
+	k := key.Bytes()
+	if err := b.writeBatch.Delete(k); err != nil {
+		return err
+	}
+	if b.ds.trackChurn.Load() {
+		b.churn += b.ds.deletedSize(k)
+	}
+	return nil
 }
 
 func (b *batch) Commit(ctx context.Context) error {
@@ -496,7 +665,8 @@ func (b *batch) commit() error {
 		return err
 	}
 	runtime.SetFinalizer(b, nil)
-	return nil
+	b.ds.addChurn(b.churn)
+	return b.ds.applyIndexOps(b.indexOps)
 }
 
 func (b *batch) Cancel() error {
@@ -512,6 +682,7 @@ func (b *batch) Cancel() error {
 
 func (b *batch) cancel() {
 	b.writeBatch.Cancel()
+	b.indexOps = nil
 	runtime.SetFinalizer(b, nil)
 }
 
@@ -528,7 +699,15 @@ func (t *txn) Put(ctx context.Context, key ds.Key, value []byte) error {
 }
 
 func (t *txn) put(key ds.Key, value []byte) error {
-	return t.txn.Set(key.Bytes(), value)
+	if err := t.updateIndexes(key, value, 0, false); err != nil {
+		return err
+	}
+	k := key.Bytes()
+	if err := t.txn.Set(k, value); err != nil {
+		return err
+	}
+	t.churn += int64(len(k) + len(value))
+	return nil
 }
 
 func (t *txn) Sync(ctx context.Context, prefix ds.Key) error {
@@ -551,7 +730,16 @@ func (t *txn) PutWithTTL(ctx context.Context, key ds.Key, value []byte, ttl time
 }
 
 func (t *txn) putWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
-	return t.txn.SetEntry(badger.NewEntry(key.Bytes(), value).WithTTL(ttl))
+	k := key.Bytes()
+	e := badger.NewEntry(k, value).WithTTL(ttl)
+	if err := t.updateIndexes(key, value, e.ExpiresAt, false); err != nil {
+		return err
+	}
+	if err := t.txn.SetEntry(e); err != nil {
+		return err
+	}
+	t.churn += int64(len(k) + len(value))
+	return nil
 }
 
 func (t *txn) GetExpiration(ctx context.Context, key ds.Key) (time.Time, error) {
@@ -672,7 +860,19 @@ func (t *txn) Delete(ctx context.Context, key ds.Key) error {
 }
 
 func (t *txn) delete(key ds.Key) error {
-	return t.txn.Delete(key.Bytes())
+	k := key.Bytes()
+	var size int64
+	if t.ds.trackChurn.Load() {
+		size = t.ds.deletedSize(k)
+	}
+	if err := t.updateIndexes(key, nil, 0, true); err != nil {
+		return err
+	}
+	if err := t.txn.Delete(k); err != nil {
+		return err
+	}
+	t.churn += size
+	return nil
 }
 
 func (t *txn) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
@@ -682,183 +882,7 @@ func (t *txn) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
 		return nil, ErrClosed
 	}
 
-	return t.query(q)
-}
-
-func (t *txn) query(q dsq.Query) (dsq.Results, error) {
-	opt := badger.DefaultIteratorOptions
-	opt.PrefetchValues = !q.KeysOnly
-	prefix := ds.NewKey(q.Prefix).String()
-	if prefix != "/" {
-		opt.Prefix = []byte(prefix + "/")
-	}
-
-	// Handle ordering
-	if len(q.Orders) > 0 {
-		switch q.Orders[0].(type) {
-		case dsq.OrderByKey, *dsq.OrderByKey:
-		// We order by key by default.
-		case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
-			// Reverse order by key
-			opt.Reverse = true
-		default:
-			// Ok, we have a weird order we can't handle. Let's
-			// perform the _base_ query (prefix, filter, etc.), then
-			// handle sort/offset/limit later.
-
-			// Skip the stuff we can't apply.
-			baseQuery := q
-			baseQuery.Limit = 0
-			baseQuery.Offset = 0
-			baseQuery.Orders = nil
-
-			// perform the base query.
-			res, err := t.query(baseQuery)
-			if err != nil {
-				return nil, err
-			}
-
-			// fix the query
-			res = dsq.ResultsReplaceQuery(res, q)
-
-			// Remove the parts we've already applied.
-			naiveQuery := q
-			naiveQuery.Prefix = ""
-			naiveQuery.Filters = nil
-
-			// Apply the rest of the query
-			return dsq.NaiveQueryApply(naiveQuery, res), nil
-		}
-	}
-
-	it := t.txn.NewIterator(opt)
-	results := dsq.ResultsWithContext(q, func(ctx context.Context, output chan<- dsq.Result) {
-		t.ds.closeLk.RLock()
-		closedEarly := false
-		defer func() {
-			t.ds.closeLk.RUnlock()
-			if closedEarly {
-				select {
-				case output <- dsq.Result{
-					Error: ErrClosed,
-				}:
-				case <-ctx.Done():
-				}
-			}
-
-		}()
-		if t.ds.closed {
-			closedEarly = true
-			return
-		}
-
-		// this iterator is part of an implicit transaction, so when
-		// we're done we must discard the transaction. It's safe to
-		// discard the txn it because it contains the iterator only.
-		if t.implicit {
-			defer t.discard()
-		}
-
-		defer it.Close()
-
-		// All iterators must be started by rewinding.
-		it.Rewind()
-
-		// skip to the offset
-		for skipped := 0; skipped < q.Offset && it.Valid(); it.Next() {
-			// On the happy path, we have no filters and we can go
-			// on our way.
-			if len(q.Filters) == 0 {
-				skipped++
-				continue
-			}
-
-			// On the sad path, we need to apply filters before
-			// counting the item as "skipped" as the offset comes
-			// _after_ the filter.
-			item := it.Item()
-
-			matches := true
-			check := func(value []byte) error {
-				e := dsq.Entry{
-					Key:   string(item.Key()),
-					Value: value,
-					Size:  int(item.ValueSize()), // this function is basically free
-				}
-
-				// Only calculate expirations if we need them.
-				if q.ReturnExpirations {
-					e.Expiration = expires(item)
-				}
-				matches = filter(q.Filters, e)
-				return nil
-			}
-
-			// Maybe check with the value, only if we need it.
-			var err error
-			if q.KeysOnly {
-				err = check(nil)
-			} else {
-				err = item.Value(check)
-			}
-
-			if err != nil {
-				select {
-				case output <- dsq.Result{Error: err}:
-				case <-t.ds.closing: // datastore closing.
-					closedEarly = true
-					return
-				case <-ctx.Done(): // client told us to close early
-					return
-				}
-			}
-			if !matches {
-				skipped++
-			}
-		}
-
-		for sent := 0; (q.Limit <= 0 || sent < q.Limit) && it.Valid(); it.Next() {
-			item := it.Item()
-			e := dsq.Entry{Key: string(item.Key())}
-
-			// Maybe get the value
-			var result dsq.Result
-			if !q.KeysOnly {
-				b, err := item.ValueCopy(nil)
-				if err != nil {
-					result = dsq.Result{Error: err}
-				} else {
-					e.Value = b
-					e.Size = len(b)
-					result = dsq.Result{Entry: e}
-				}
-			} else {
-				e.Size = int(item.ValueSize())
-				result = dsq.Result{Entry: e}
-			}
-
-			if q.ReturnExpirations {
-				result.Expiration = expires(item)
-			}
-
-			// Finally, filter it (unless we're dealing with an error).
-			if result.Error == nil && filter(q.Filters, e) {
-				continue
-			}
-
-			select {
-			case output <- result:
-				sent++
-			case <-t.ds.closing: // datastore closing.
-				closedEarly = true
-				return
-			case <-ctx.Done(): // client told us to close early
-				return
-			}
-		}
-	})
-
-	return results, nil
+	return t.query(q, t.ds.queryLimits(ctx))
 }
 
 func (t *txn) Commit(ctx context.Context) error {
@@ -872,7 +896,11 @@ func (t *txn) Commit(ctx context.Context) error {
 }
 
 func (t *txn) commit() error {
-	return t.txn.Commit()
+	if err := t.txn.Commit(); err != nil {
+		return err
+	}
+	t.ds.addChurn(t.churn)
+	return nil
 }
 
 // Alias to commit
@@ -886,7 +914,7 @@ func (t *txn) Close() error {
 }
 
 func (t *txn) close() error {
-	return t.txn.Commit()
+	return t.commit()
 }
 
 func (t *txn) Discard(ctx context.Context) {
@@ -902,17 +930,3 @@ func (t *txn) Discard(ctx context.Context) {
 func (t *txn) discard() {
 	t.txn.Discard()
 }
-
-// filter returns _true_ if we should filter (skip) the entry
-func filter(filters []dsq.Filter, entry dsq.Entry) bool {
-	for _, f := range filters {
-		if !f.Filter(entry) {
-			return true
-		}
-	}
-	return false
-}
-
-func expires(item *badger.Item) time.Time {
-	return time.Unix(int64(item.ExpiresAt()), 0)
-}
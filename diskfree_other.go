@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package badger
+
+import "errors"
+
+var errDiskFreeUnsupported = errors.New("checking free disk space is not supported on this platform")
+
+func diskFree(path string) (free, total uint64, err error) {
+	return 0, 0, errDiskFreeUnsupported
+}
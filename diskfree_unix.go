@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+
+package badger
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskFree returns the number of bytes available to unprivileged users and
+// the total size of the filesystem holding path.
+func diskFree(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	if st.Blocks == 0 {
+		return 0, 0, fmt.Errorf("filesystem holding %s reports no size", path)
+	}
+	// The field types differ between platforms.
+	bsize := uint64(st.Bsize)
+	return uint64(st.Bavail) * bsize, uint64(st.Blocks) * bsize, nil
+}
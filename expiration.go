@@ -0,0 +1,133 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ErrNoExpirationIndex is returned by QueryExpiring when the expiration
+// index isn't enabled, see Options.ExpirationIndex.
+var ErrNoExpirationIndex = errors.New("expiration index not enabled")
+
+// expirationNamespace prefixes the keys of the expiration index entries,
+// made of the expiration of a key followed by the key. Like index entries,
+// queries never see them.
+const expirationNamespace = "!expires!"
+
+func expirationKey(expiresAt uint64, key []byte) []byte {
+	k := make([]byte, 0, len(expirationNamespace)+8+len(key))
+	k = append(k, expirationNamespace...)
+	k = binary.BigEndian.AppendUint64(k, expiresAt)
+	return append(k, key...)
+}
+
+// QueryExpiring returns the keys under prefix expiring before the given
+// time, with their expiration, ordered by expiration. Expired keys aren't
+// returned. The results hold no values, but their size.
+//
+// Only keys written with a TTL since the expiration index was enabled are
+// returned, see Options.ExpirationIndex. The QueryLimits count the entries
+// of the index examined.
+func (d *Datastore) QueryExpiring(ctx context.Context, prefix string, before time.Time) (dsq.Results, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	if !d.expirationIndex {
+		return nil, ErrNoExpirationIndex
+	}
+
+	q := dsq.Query{Prefix: prefix, KeysOnly: true, ReturnExpirations: true}
+	txn := d.newImplicitTransaction(true)
+	return txn.iterResults(q, txn.newExpiringIter(prefix, before, d.queryLimits(ctx))), nil
+}
+
+// expiringIter walks the expiration index.
+type expiringIter struct {
+	t      *txn
+	it     *badger.Iterator
+	prefix []byte
+	before time.Time
+
+	limits QueryLimits
+	stats  *queryStats
+
+	started bool
+	stopped bool
+}
+
+func (t *txn) newExpiringIter(prefix string, before time.Time, limits QueryLimits) *expiringIter {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.Prefix = []byte(expirationNamespace)
+	return &expiringIter{
+		t:      t,
+		it:     t.txn.NewIterator(opt),
+		prefix: queryPrefix(prefix),
+		before: before,
+		limits: limits,
+		stats:  newQueryStats(),
+	}
+}
+
+func (ei *expiringIter) next([]byte) (dsq.Result, bool) {
+	if ei.stopped {
+		return dsq.Result{}, false
+	}
+	if !ei.started {
+		ei.it.Rewind()
+		ei.started = true
+	} else {
+		ei.it.Next()
+	}
+
+	for ; ei.it.Valid(); ei.it.Next() {
+		ei.stats.scan()
+		if err := ei.stats.check(ei.limits); err != nil {
+			ei.stopped = true
+			return dsq.Result{Error: err}, true
+		}
+
+		k := ei.it.Item().Key()[len(expirationNamespace):]
+		expiration := time.Unix(int64(binary.BigEndian.Uint64(k)), 0)
+		if !expiration.Before(ei.before) {
+			return dsq.Result{}, false
+		}
+		key := k[8:]
+		if !bytes.HasPrefix(key, ei.prefix) {
+			continue
+		}
+
+		// Entries written by batches don't remove the previous
+		// expiration of the keys they overwrite.
+		item, err := ei.t.txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return dsq.Result{Error: err}, true
+		}
+		if !expires(item).Equal(expiration) {
+			continue
+		}
+
+		return dsq.Result{Entry: dsq.Entry{
+			Key:        string(key),
+			Size:       int(item.ValueSize()),
+			Expiration: expiration,
+		}}, true
+	}
+	return dsq.Result{}, false
+}
+
+func (ei *expiringIter) close() {
+	ei.it.Close()
+}
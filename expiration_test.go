@@ -0,0 +1,144 @@
+package badger
+
+import (
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// countExpirationEntries returns the number of entries in the expiration
+// index.
+func countExpirationEntries(t *testing.T, d *Datastore) int {
+	t.Helper()
+	n := 0
+	err := d.DB.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = []byte(expirationNamespace)
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestQueryExpiring(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.QueryExpiring(bg, "/", time.Now()); err != ErrNoExpirationIndex {
+		t.Fatalf("expected ErrNoExpirationIndex, got %v", err)
+	}
+	d.Close()
+
+	opts := DefaultOptions
+	opts.ExpirationIndex = true
+	d, err = NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for k, ttl := range map[string]time.Duration{
+		"/dht/a":   3 * time.Hour,
+		"/dht/b":   time.Hour,
+		"/dht/c":   2 * time.Hour,
+		"/dht/d":   4 * time.Hour,
+		"/other/a": 30 * time.Minute,
+	} {
+		if err := d.PutWithTTL(bg, ds.NewKey(k), []byte(k), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(bg, ds.NewKey("/dht/e"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Add(150 * time.Minute)
+	res, err := d.QueryExpiring(bg, "/dht", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/dht/b" || entries[1].Key != "/dht/c" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	for _, e := range entries {
+		exp, err := d.GetExpiration(bg, ds.NewKey(e.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !e.Expiration.Equal(exp) || e.Size != len(e.Key) {
+			t.Fatalf("unexpected entry %v, expires at %s", e, exp)
+		}
+	}
+
+	res, err = d.QueryExpiring(bg, "/", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/other/a", "/dht/b", "/dht/c"}, res)
+
+	// The entries of the index count towards the limits.
+	res, err = d.QueryExpiring(WithQueryLimits(bg, QueryLimits{MaxScanned: 2}), "/", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = res.Rest()
+	expectLimitError(t, err, "MaxScanned")
+
+	// Overwriting and deleting keys removes their previous expiration.
+	if err := d.SetTTL(bg, ds.NewKey("/dht/b"), 5*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(bg, ds.NewKey("/dht/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(bg, ds.NewKey("/other/a")); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExpirationEntries(t, d); n != 3 {
+		t.Fatalf("expected 3 expiration entries, got %d", n)
+	}
+	res, err = d.QueryExpiring(bg, "/", time.Now().Add(10*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/dht/a", "/dht/d", "/dht/b"}, res)
+
+	// Batches can't, but the stale expirations aren't returned.
+	b, err := d.Batch(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(bg, ds.NewKey("/dht/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(bg); err != nil {
+		t.Fatal(err)
+	}
+	res, err = d.QueryExpiring(bg, "/", time.Now().Add(10*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/dht/d", "/dht/b"}, res)
+
+	// The index isn't visible to queries.
+	res, err = d.Query(bg, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/dht/a", "/dht/b", "/dht/c", "/dht/d", "/dht/e"}, res)
+}
@@ -0,0 +1,145 @@
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// PlanOrder tells how the results of a query are ordered.
+type PlanOrder int
+
+const (
+	// PlanScan iterates over keys in ascending order.
+	PlanScan PlanOrder = iota
+	// PlanReverseScan iterates over keys in descending order.
+	PlanReverseScan
+	// PlanSort iterates over keys in ascending order, then sorts the
+	// results, spilling them to disk if they don't fit in
+	// Options.QuerySortMemory.
+	PlanSort
+)
+
+func (o PlanOrder) String() string {
+	switch o {
+	case PlanScan:
+		return "scan"
+	case PlanReverseScan:
+		return "reverse scan"
+	case PlanSort:
+		return "sort"
+	default:
+		return fmt.Sprintf("PlanOrder(%d)", int(o))
+	}
+}
+
+// QueryPlan describes how a query is run, see Explain.
+type QueryPlan struct {
+	// Prefix is the prefix of the keys iterated over, empty for all keys.
+	Prefix string
+	// Start and End bound the keys iterated over, End excluded. They're
+	// empty when unbounded.
+	Start, End string
+
+	Order PlanOrder
+
+	// PushedFilters are turned into the Start and End bounds, and never
+	// evaluated.
+	PushedFilters []dsq.Filter
+	// PatternFilters narrow the Start and End bounds to the keys under
+	// their literal prefix. They're evaluated for every key first, seeking
+	// past the keys around it that can't match either.
+	PatternFilters []dsq.Filter
+	// KeyFilters are evaluated for every key, before loading its value.
+	KeyFilters []dsq.Filter
+	// ValueFilters are evaluated for every key passing KeyFilters, after
+	// loading its value unless the query is KeysOnly.
+	ValueFilters []dsq.Filter
+
+	// PrefetchValues tells whether values are loaded ahead of the keys
+	// being iterated over.
+	PrefetchValues bool
+	// Buffered tells whether all the results are read before returning
+	// the first one. Offset and Limit are then applied after sorting.
+	Buffered bool
+}
+
+func (p QueryPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s prefix=%q range=[%q, %q)", p.Order, p.Prefix, p.Start, p.End)
+	writeFilters := func(name string, filters []dsq.Filter) {
+		if len(filters) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, " %s=[", name)
+		for i, f := range filters {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprint(&b, f)
+		}
+		b.WriteString("]")
+	}
+	writeFilters("pushed", p.PushedFilters)
+	writeFilters("pattern", p.PatternFilters)
+	writeFilters("key", p.KeyFilters)
+	writeFilters("value", p.ValueFilters)
+	fmt.Fprintf(&b, " prefetch=%t buffered=%t", p.PrefetchValues, p.Buffered)
+	return b.String()
+}
+
+// Explain returns how Query runs q. It doesn't read the datastore.
+//
+// When debug logging is enabled, queries log their plan along with the
+// number of entries they scanned, the value bytes they loaded and the
+// results they produced.
+func (d *Datastore) Explain(q dsq.Query) QueryPlan {
+	return explain(q)
+}
+
+func explain(q dsq.Query) QueryPlan {
+	prefix := queryPrefix(q.Prefix)
+	keys, rest := queryRange(prefix, q.Filters)
+	_, patterns, rest := splitPatterns(rest)
+	filters := splitFilters(rest)
+
+	// Without a prefix, the range is bound to the datastore's keys, which
+	// are all the keys as far as the plan is concerned.
+	if prefix == nil {
+		all := prefixRange([]byte("/"))
+		if bytes.Equal(keys.start, all.start) {
+			keys.start = nil
+		}
+		if bytes.Equal(keys.end, all.end) {
+			keys.end = nil
+		}
+	}
+
+	p := QueryPlan{
+		Prefix:         string(prefix),
+		Start:          string(keys.start),
+		End:            string(keys.end),
+		PatternFilters: patterns,
+		KeyFilters:     filters.early,
+		ValueFilters:   filters.late,
+		PrefetchValues: !q.KeysOnly,
+	}
+	for _, f := range q.Filters {
+		if _, ok := filterRange(f); ok {
+			p.PushedFilters = append(p.PushedFilters, f)
+		}
+	}
+
+	switch reverse, ok := keyOrder(q); {
+	case !ok:
+		p.Order = PlanSort
+		p.Buffered = true
+	case reverse:
+		p.Order = PlanReverseScan
+	default:
+		p.Order = PlanScan
+	}
+	return p
+}
@@ -0,0 +1,60 @@
+package badger
+
+import (
+	"testing"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestExplain(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	p := d.Explain(dsq.Query{})
+	if p.Order != PlanScan || p.Prefix != "" || p.Start != "" || p.End != "" || !p.PrefetchValues || p.Buffered {
+		t.Fatalf("unexpected plan %s", p)
+	}
+
+	// Bounds from filters are reported even without a prefix.
+	p = d.Explain(dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/b"}}})
+	if p.Start != "" || p.End != "/b" {
+		t.Fatalf("unexpected plan %s", p)
+	}
+
+	pushed := dsq.FilterKeyCompare{Op: dsq.GreaterThanOrEqual, Key: "/a/c"}
+	notEqual := dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/d"}
+	size := FilterSizeCompare{Op: dsq.GreaterThan, Size: 1}
+	value := dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("ac")}
+	p = d.Explain(dsq.Query{
+		Prefix:   "/a",
+		Filters:  []dsq.Filter{pushed, notEqual, size, value},
+		Orders:   []dsq.Order{dsq.OrderByKeyDescending{}},
+		KeysOnly: true,
+	})
+	if p.Order != PlanReverseScan || p.Prefix != "/a/" || p.Start != "/a/c" || p.End != "/a0" || p.PrefetchValues || p.Buffered {
+		t.Fatalf("unexpected plan %s", p)
+	}
+	if len(p.PushedFilters) != 1 || p.PushedFilters[0] != pushed {
+		t.Fatalf("unexpected pushed filters %v", p.PushedFilters)
+	}
+	if len(p.KeyFilters) != 2 || p.KeyFilters[0] != notEqual || p.KeyFilters[1] != size {
+		t.Fatalf("unexpected key filters %v", p.KeyFilters)
+	}
+	if len(p.ValueFilters) != 1 {
+		t.Fatalf("unexpected value filters %v", p.ValueFilters)
+	}
+
+	p = d.Explain(dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByValue{}, dsq.OrderByKey{}}})
+	if p.Order != PlanSort || !p.Buffered || p.Prefix != "/a/" {
+		t.Fatalf("unexpected plan %s", p)
+	}
+
+	const expected = `reverse scan prefix="/a/" range=["/a/c", "/a0") pushed=[KEY >= "/a/c"] prefetch=false buffered=false`
+	p = d.Explain(dsq.Query{Prefix: "/a", Filters: []dsq.Filter{pushed}, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, KeysOnly: true})
+	if p.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, p)
+	}
+}
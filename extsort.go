@@ -0,0 +1,410 @@
+package badger
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// defaultSortMemory is the memory budget of a sort if
+	// Options.QuerySortMemory isn't set.
+	defaultSortMemory = 64 << 20
+
+	// sortEntryOverhead is a rough estimate of the memory used by a
+	// buffered entry on top of its key and value.
+	sortEntryOverhead = 128
+
+	// sortFilePattern is the name of the files sorted runs are spilled to.
+	sortFilePattern = "query-sort-*.tmp"
+
+	// maxSortFanIn is the most runs merged at once, bounding the number of
+	// files open during a sort.
+	maxSortFanIn = 16
+)
+
+var errCorruptSortFile = errors.New("corrupt query sort file")
+
+// sortResults applies the orders, offset and limit of q to res, keeping at
+// most d.sortMemory bytes of entries in memory and spilling the rest to
+// sorted temporary files which are then merged.
+func (d *Datastore) sortResults(q dsq.Query, res dsq.Results) dsq.Results {
+	return dsq.ResultsWithContext(q, func(ctx context.Context, output chan<- dsq.Result) {
+		defer res.Close()
+
+		send := func(r dsq.Result) bool {
+			select {
+			case output <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		s := &externalSort{dir: d.path, budget: d.sortMemory, orders: q.Orders}
+		defer s.close()
+		for {
+			var r dsq.Result
+			var ok bool
+			select {
+			case r, ok = <-res.Next():
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				break
+			}
+			if r.Error != nil {
+				send(r)
+				return
+			}
+			if err := s.add(r.Entry); err != nil {
+				send(dsq.Result{Error: err})
+				return
+			}
+		}
+
+		next, err := s.sorted()
+		if err != nil {
+			send(dsq.Result{Error: err})
+			return
+		}
+		for skipped, sent := 0, 0; q.Limit <= 0 || sent < q.Limit; {
+			e, ok, err := next()
+			if err != nil {
+				send(dsq.Result{Error: err})
+				return
+			}
+			if !ok {
+				return
+			}
+			if skipped < q.Offset {
+				skipped++
+				continue
+			}
+			if !send(dsq.Result{Entry: e}) {
+				return
+			}
+			sent++
+		}
+	})
+}
+
+// removeSortFiles removes the sort files left behind by a crash.
+func removeSortFiles(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, sortFilePattern))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			log.Warnf("failed to remove query sort file %s: %s", f, err)
+		}
+	}
+}
+
+// externalSort sorts entries, spilling them to disk in sorted runs when
+// they don't fit in its memory budget. Runs are merged as they accumulate,
+// maxSortFanIn of the same level at a time, so that there are only a few of
+// them to merge in the end.
+type externalSort struct {
+	dir    string
+	budget int64
+	orders []dsq.Order
+
+	buf     []dsq.Entry
+	bufSize int64
+	runs    []sortRun
+	open    []*os.File
+}
+
+// sortRun is a sorted run spilled to a file. Runs merged from others are one
+// level above the highest of them.
+type sortRun struct {
+	name  string
+	level int
+}
+
+func (s *externalSort) add(e dsq.Entry) error {
+	s.buf = append(s.buf, e)
+	s.bufSize += int64(len(e.Key)+len(e.Value)) + sortEntryOverhead
+	if s.bufSize < s.budget {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill writes the buffered entries to a new sorted run, and merges the
+// last runs if there are enough of them at the same level.
+func (s *externalSort) spill() error {
+	dsq.Sort(s.orders, s.buf)
+	mem := &memRun{entries: s.buf}
+	if err := s.writeRun(0, mem.next); err != nil {
+		return err
+	}
+	clear(s.buf)
+	s.buf = s.buf[:0]
+	s.bufSize = 0
+
+	for n := len(s.runs); n >= maxSortFanIn && s.runs[n-maxSortFanIn].level == s.runs[n-1].level; n = len(s.runs) {
+		if err := s.mergeRuns(maxSortFanIn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRun writes the entries returned by next to a new run.
+func (s *externalSort) writeRun(level int, next func() (dsq.Entry, bool, error)) error {
+	f, err := os.CreateTemp(s.dir, sortFilePattern)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.runs = append(s.runs, sortRun{name: f.Name(), level: level})
+
+	w := bufio.NewWriter(f)
+	for {
+		e, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		writeSortEntry(w, e)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// openRuns opens runs and pushes them to a merge.
+func (s *externalSort) openRuns(m *sortMerge, runs []sortRun) error {
+	for _, run := range runs {
+		f, err := os.Open(run.name)
+		if err != nil {
+			return err
+		}
+		s.open = append(s.open, f)
+		r := &fileRun{r: bufio.NewReader(f)}
+		if err := m.push(r.next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeRuns merges the last n runs into a single one.
+func (s *externalSort) mergeRuns(n int) error {
+	runs := slices.Clone(s.runs[len(s.runs)-n:])
+	s.runs = s.runs[:len(s.runs)-n]
+	defer removeSortRuns(runs)
+	defer s.closeOpen()
+
+	level := 0
+	for _, run := range runs {
+		level = max(level, run.level+1)
+	}
+	m := &sortMerge{orders: s.orders}
+	if err := s.openRuns(m, runs); err != nil {
+		return err
+	}
+	return s.writeRun(level, m.next)
+}
+
+// sorted returns a function iterating over all the entries in order.
+func (s *externalSort) sorted() (func() (dsq.Entry, bool, error), error) {
+	dsq.Sort(s.orders, s.buf)
+	mem := &memRun{entries: s.buf}
+	if len(s.runs) == 0 {
+		return mem.next, nil
+	}
+
+	// Leave room for the buffered entries in the final merge.
+	for len(s.runs) >= maxSortFanIn {
+		if err := s.mergeRuns(min(maxSortFanIn, len(s.runs)-maxSortFanIn+2)); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &sortMerge{orders: s.orders}
+	if err := s.openRuns(m, s.runs); err != nil {
+		return nil, err
+	}
+	if err := m.push(mem.next); err != nil {
+		return nil, err
+	}
+	return m.next, nil
+}
+
+// close removes the spilled runs.
+func (s *externalSort) close() {
+	s.closeOpen()
+	removeSortRuns(s.runs)
+	s.runs = nil
+}
+
+func (s *externalSort) closeOpen() {
+	for _, f := range s.open {
+		f.Close()
+	}
+	s.open = nil
+}
+
+func removeSortRuns(runs []sortRun) {
+	for _, run := range runs {
+		if err := os.Remove(run.name); err != nil {
+			log.Warnf("failed to remove query sort file %s: %s", run.name, err)
+		}
+	}
+}
+
+type memRun struct {
+	entries []dsq.Entry
+}
+
+func (r *memRun) next() (dsq.Entry, bool, error) {
+	if len(r.entries) == 0 {
+		return dsq.Entry{}, false, nil
+	}
+	e := r.entries[0]
+	r.entries = r.entries[1:]
+	return e, true, nil
+}
+
+type fileRun struct {
+	r *bufio.Reader
+}
+
+func (r *fileRun) next() (dsq.Entry, bool, error) {
+	e, err := readSortEntry(r.r)
+	if err == io.EOF {
+		return dsq.Entry{}, false, nil
+	}
+	return e, err == nil, err
+}
+
+// sortMerge merges sorted runs, as a heap of their next entries.
+type sortMerge struct {
+	orders []dsq.Order
+	heads  []mergeHead
+}
+
+type mergeHead struct {
+	e    dsq.Entry
+	next func() (dsq.Entry, bool, error)
+}
+
+func (m *sortMerge) Len() int           { return len(m.heads) }
+func (m *sortMerge) Less(i, j int) bool { return dsq.Less(m.orders, m.heads[i].e, m.heads[j].e) }
+func (m *sortMerge) Swap(i, j int)      { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+func (m *sortMerge) Push(x any)         { m.heads = append(m.heads, x.(mergeHead)) }
+func (m *sortMerge) Pop() any {
+	h := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return h
+}
+
+// push adds a run to the merge.
+func (m *sortMerge) push(next func() (dsq.Entry, bool, error)) error {
+	e, ok, err := next()
+	if err != nil || !ok {
+		return err
+	}
+	heap.Push(m, mergeHead{e: e, next: next})
+	return nil
+}
+
+func (m *sortMerge) next() (dsq.Entry, bool, error) {
+	if len(m.heads) == 0 {
+		return dsq.Entry{}, false, nil
+	}
+	head := &m.heads[0]
+	e := head.e
+	next, ok, err := head.next()
+	if err != nil {
+		return dsq.Entry{}, false, err
+	}
+	if ok {
+		head.e = next
+		heap.Fix(m, 0)
+	} else {
+		heap.Pop(m)
+	}
+	return e, true, nil
+}
+
+// writeSortEntry encodes an entry as its key, value, size and expiration.
+// Errors are reported by the writer's Flush.
+func writeSortEntry(w *bufio.Writer, e dsq.Entry) {
+	var buf [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) {
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+		w.Write(b)
+	}
+	writeBytes([]byte(e.Key))
+	writeBytes(e.Value)
+	w.Write(buf[:binary.PutVarint(buf[:], int64(e.Size))])
+	if e.Expiration.IsZero() {
+		w.WriteByte(0)
+	} else {
+		w.WriteByte(1)
+		w.Write(buf[:binary.PutVarint(buf[:], e.Expiration.UnixNano())])
+	}
+}
+
+func readSortEntry(r *bufio.Reader) (dsq.Entry, error) {
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errCorruptSortFile
+		}
+		return b, nil
+	}
+
+	var e dsq.Entry
+	key, err := readBytes()
+	if err != nil {
+		// A clean EOF before the next entry ends the run.
+		return e, err
+	}
+	e.Key = string(key)
+	if e.Value, err = readBytes(); err != nil {
+		return e, errCorruptSortFile
+	}
+	size, err := binary.ReadVarint(r)
+	if err != nil {
+		return e, errCorruptSortFile
+	}
+	e.Size = int(size)
+	hasExpiration, err := r.ReadByte()
+	if err != nil {
+		return e, errCorruptSortFile
+	}
+	if hasExpiration == 1 {
+		exp, err := binary.ReadVarint(r)
+		if err != nil {
+			return e, errCorruptSortFile
+		}
+		e.Expiration = time.Unix(0, exp)
+	}
+	return e, nil
+}
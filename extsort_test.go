@@ -0,0 +1,182 @@
+package badger
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestExternalSort(t *testing.T) {
+	orders := []dsq.Order{dsq.OrderByValue{}}
+	s := &externalSort{dir: t.TempDir(), budget: 4096, orders: orders}
+	defer s.close()
+
+	var entries []dsq.Entry
+	exp := time.Unix(1700000000, 0)
+	for i := 0; i < 1000; i++ {
+		value := make([]byte, 8)
+		rand.Read(value)
+		e := dsq.Entry{Key: fmt.Sprintf("/sort/%d", i), Value: value, Size: len(value)}
+		if i%2 == 0 {
+			e.Expiration = exp
+		}
+		entries = append(entries, e)
+		if err := s.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.runs) < 2 {
+		t.Fatalf("expected several runs, got %d", len(s.runs))
+	}
+
+	next, err := s.sorted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsq.Sort(orders, entries)
+	for i, expected := range entries {
+		e, ok, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected %d entries, got %d", len(entries), i)
+		}
+		if e.Key != expected.Key || string(e.Value) != string(expected.Value) ||
+			e.Size != expected.Size || !e.Expiration.Equal(expected.Expiration) {
+			t.Fatalf("entry %d: expected %v, got %v", i, expected, e)
+		}
+	}
+	if _, ok, _ := next(); ok {
+		t.Fatal("expected no more entries")
+	}
+
+	runs := s.runs
+	s.close()
+	for _, run := range runs {
+		if _, err := os.Stat(run.name); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", run.name)
+		}
+	}
+}
+
+func TestExternalSortManyRuns(t *testing.T) {
+	dir := t.TempDir()
+	orders := []dsq.Order{dsq.OrderByKey{}}
+	// Every entry is spilled to a run of its own.
+	s := &externalSort{dir: dir, budget: 1, orders: orders}
+	defer s.close()
+
+	const count = 3000
+	for i := 0; i < count; i++ {
+		if err := s.add(dsq.Entry{Key: fmt.Sprintf("/sort/%d", (i*7919)%count)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, sortFilePattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(s.runs) || len(files) > 3*maxSortFanIn {
+		t.Fatalf("expected runs to be merged, got %d runs in %d files", len(s.runs), len(files))
+	}
+	if len(s.open) != 0 {
+		t.Fatalf("expected no open runs, got %d", len(s.open))
+	}
+
+	next, err := s.sorted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.open) >= maxSortFanIn {
+		t.Fatalf("expected at most %d open runs, got %d", maxSortFanIn-1, len(s.open))
+	}
+	var last string
+	for i := 0; i < count; i++ {
+		e, ok, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected %d entries, got %d", count, i)
+		}
+		if e.Key <= last {
+			t.Fatalf("expected %s after %s", e.Key, last)
+		}
+		last = e.Key
+	}
+	if _, ok, _ := next(); ok {
+		t.Fatal("expected no more entries")
+	}
+}
+
+func TestQuerySpillingSort(t *testing.T) {
+	path := t.TempDir()
+	opts := DefaultOptions
+	opts.QuerySortMemory = 4096
+	d, err := NewDatastore(path, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var entries []dsq.Entry
+	for i := 0; i < 500; i++ {
+		value := make([]byte, 8)
+		rand.Read(value)
+		key := fmt.Sprintf("/sort/%03d", i)
+		if err := d.Put(bg, ds.NewKey(key), value); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, dsq.Entry{Key: key, Value: value})
+	}
+	if err := d.Put(bg, ds.NewKey("/other"), nil); err != nil {
+		t.Fatal(err)
+	}
+	dsq.Sort([]dsq.Order{dsq.OrderByValueDescending{}}, entries)
+
+	res, err := d.Query(bg, dsq.Query{
+		Prefix: "/sort",
+		Orders: []dsq.Order{dsq.OrderByValueDescending{}},
+		Offset: 100,
+		Limit:  250,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, e := range entries[100:350] {
+		expected = append(expected, e.Key)
+	}
+	expectKeys(t, expected, res)
+
+	sortFiles, err := filepath.Glob(filepath.Join(path, sortFilePattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sortFiles) != 0 {
+		t.Fatalf("expected sort files to be removed, found %v", sortFiles)
+	}
+}
+
+func TestRemoveSortFiles(t *testing.T) {
+	path := t.TempDir()
+	leftover := filepath.Join(path, "query-sort-123.tmp")
+	if err := os.WriteFile(leftover, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDatastore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatal("expected leftover sort files to be removed on open")
+	}
+}
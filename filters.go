@@ -0,0 +1,152 @@
+package badger
+
+import (
+	"fmt"
+
+	badger "github.com/dgraph-io/badger"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// FilterSizeCompare is a query filter comparing the size of values.
+//
+// Queries on a badger Datastore evaluate it without loading values.
+type FilterSizeCompare struct {
+	Op   dsq.Op
+	Size int
+}
+
+var _ dsq.Filter = FilterSizeCompare{}
+
+func (f FilterSizeCompare) Filter(e dsq.Entry) bool {
+	switch f.Op {
+	case dsq.Equal:
+		return e.Size == f.Size
+	case dsq.NotEqual:
+		return e.Size != f.Size
+	case dsq.GreaterThan:
+		return e.Size > f.Size
+	case dsq.GreaterThanOrEqual:
+		return e.Size >= f.Size
+	case dsq.LessThan:
+		return e.Size < f.Size
+	case dsq.LessThanOrEqual:
+		return e.Size <= f.Size
+	default:
+		panic(fmt.Errorf("unknown op '%s'", f.Op))
+	}
+}
+
+func (f FilterSizeCompare) String() string {
+	return fmt.Sprintf("SIZE %s %d", f.Op, f.Size)
+}
+
+// filterClass tells what a filter looks at.
+type filterClass int
+
+const (
+	keyFilter filterClass = iota
+	sizeFilter
+	valueFilter
+)
+
+// classifyFilter returns what a filter looks at. Unknown filters are assumed
+// to need the whole entry.
+func classifyFilter(f dsq.Filter) filterClass {
+	switch f.(type) {
+	case dsq.FilterKeyCompare, *dsq.FilterKeyCompare,
+		dsq.FilterKeyPrefix, *dsq.FilterKeyPrefix,
+		FilterKeyRange, *FilterKeyRange,
+		FilterKeyPattern, *FilterKeyPattern:
+		return keyFilter
+	case FilterSizeCompare, *FilterSizeCompare:
+		return sizeFilter
+	default:
+		return valueFilter
+	}
+}
+
+// queryFilters are the filters of a query, split between the ones that can
+// be evaluated before loading values and the others.
+type queryFilters struct {
+	early, late []dsq.Filter
+}
+
+func splitFilters(filters []dsq.Filter) queryFilters {
+	var f queryFilters
+	for _, filter := range filters {
+		if classifyFilter(filter) == valueFilter {
+			f.late = append(f.late, filter)
+		} else {
+			f.early = append(f.early, filter)
+		}
+	}
+	return f
+}
+
+func (f queryFilters) empty() bool {
+	return len(f.early) == 0 && len(f.late) == 0
+}
+
+// itemEntry returns the entry for an item, without its value.
+func itemEntry(item *badger.Item, q dsq.Query) dsq.Entry {
+	e := dsq.Entry{
+		Key:  string(item.Key()),
+		Size: int(item.ValueSize()), // this function is basically free
+	}
+	// Only calculate expirations if we need them.
+	if q.ReturnExpirations {
+		e.Expiration = expires(item)
+	}
+	return e
+}
+
+// matchItem tells whether an item passes the filters, only loading its
+// value if the filters on its key and size pass and others remain.
+func matchItem(item *badger.Item, q dsq.Query, f queryFilters, stats *queryStats) (bool, error) {
+	e := itemEntry(item, q)
+	if filter(f.early, e) {
+		return false, nil
+	}
+	if len(f.late) == 0 {
+		return true, nil
+	}
+	// Keys only queries filter entries without their values.
+	if q.KeysOnly {
+		return !filter(f.late, e), nil
+	}
+	matches := false
+	err := item.Value(func(value []byte) error {
+		stats.loaded(len(value))
+		e.Value = value
+		matches = !filter(f.late, e)
+		return nil
+	})
+	return matches, err
+}
+
+// itemResult returns the query result for an item, and false if it doesn't
+// pass the filters. Its value is only loaded once the filters on its key
+// and size passed, into buf if it's large enough.
+func itemResult(item *badger.Item, q dsq.Query, f queryFilters, buf []byte, stats *queryStats) (dsq.Result, bool) {
+	e := itemEntry(item, q)
+	if filter(f.early, e) {
+		return dsq.Result{}, false
+	}
+
+	// Maybe get the value
+	if !q.KeysOnly {
+		b, err := item.ValueCopy(buf)
+		if err != nil {
+			return dsq.Result{Error: err}, true
+		}
+		stats.loaded(len(b))
+		e.Value = b
+		e.Size = len(b)
+	}
+
+	// Finally, filter it.
+	if filter(f.late, e) {
+		return dsq.Result{}, false
+	}
+	return dsq.Result{Entry: e}, true
+}
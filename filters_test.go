@@ -0,0 +1,74 @@
+package badger
+
+import (
+	"testing"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// countingFilter is a value filter recording the entries it's called with.
+type countingFilter struct {
+	seen *[]string
+}
+
+func (f countingFilter) Filter(e dsq.Entry) bool {
+	*f.seen = append(*f.seen, e.Key)
+	return len(e.Value) == e.Size
+}
+
+func TestClassifyFilters(t *testing.T) {
+	f := splitFilters([]dsq.Filter{
+		dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a"},
+		&dsq.FilterKeyPrefix{Prefix: "/a"},
+		FilterSizeCompare{Op: dsq.GreaterThan, Size: 1},
+		dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("a")},
+		countingFilter{},
+	})
+	if len(f.early) != 3 || len(f.late) != 2 {
+		t.Fatalf("expected 3 early and 2 late filters, got %d and %d", len(f.early), len(f.late))
+	}
+}
+
+func TestQueryFilterOrder(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	var seen []string
+	res, err := d.Query(bg, dsq.Query{
+		Filters: []dsq.Filter{
+			countingFilter{seen: &seen},
+			dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/b/c"},
+			FilterSizeCompare{Op: dsq.GreaterThanOrEqual, Size: 2},
+		},
+		Offset: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/a/b/d", "/a/c", "/a/d"}, res)
+
+	// The value filter only sees the entries passing the key and size
+	// filters, in both the offset and result loops.
+	expected := []string{"/a/b", "/a/b/d", "/a/c", "/a/d"}
+	if len(seen) != len(expected) {
+		t.Fatalf("expected the value filter to see %v, got %v", expected, seen)
+	}
+	for i := range seen {
+		if seen[i] != expected[i] {
+			t.Fatalf("expected the value filter to see %v, got %v", expected, seen)
+		}
+	}
+
+	count, size, err := d.Count(bg, "/", []dsq.Filter{FilterSizeCompare{Op: dsq.LessThan, Size: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || size != 3 {
+		t.Fatalf("expected 4 keys and 3 bytes, got %d and %d", count, size)
+	}
+}
@@ -0,0 +1,748 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// gcHistorySize is the number of recent GC rounds kept around for GCStats.
+const gcHistorySize = 64
+
+// GCTrigger is what caused a GC round to run.
+type GCTrigger int
+
+const (
+	// GCTriggerPeriodic is the periodic GC running every GcInterval or
+	// in a maintenance window.
+	GCTriggerPeriodic GCTrigger = iota
+	// GCTriggerAdaptive is the periodic GC running because of write
+	// volume, see GcChurnThreshold and GcGrowthRatio.
+	GCTriggerAdaptive
+	// GCTriggerManual is an explicit call to CollectGarbage.
+	GCTriggerManual
+	// GCTriggerPressure is GC running because of low disk space, see
+	// GcDiskFreeThreshold.
+	GCTriggerPressure
+)
+
+func (t GCTrigger) String() string {
+	switch t {
+	case GCTriggerPeriodic:
+		return "periodic"
+	case GCTriggerAdaptive:
+		return "adaptive"
+	case GCTriggerManual:
+		return "manual"
+	case GCTriggerPressure:
+		return "pressure"
+	default:
+		return fmt.Sprintf("GCTrigger(%d)", int(t))
+	}
+}
+
+// GCOutcome summarizes how a GC round ended.
+type GCOutcome int
+
+const (
+	// GCRewrote means a value log file was rewritten.
+	GCRewrote GCOutcome = iota
+	// GCNoRewrite means there was nothing worth collecting.
+	GCNoRewrite
+	// GCRejected means another GC was already running.
+	GCRejected
+	// GCFailed means the round failed with an error.
+	GCFailed
+)
+
+func (o GCOutcome) String() string {
+	switch o {
+	case GCRewrote:
+		return "rewrote"
+	case GCNoRewrite:
+		return "no-rewrite"
+	case GCRejected:
+		return "rejected"
+	case GCFailed:
+		return "error"
+	default:
+		return fmt.Sprintf("GCOutcome(%d)", int(o))
+	}
+}
+
+// GCRound describes a single round of value log garbage collection.
+type GCRound struct {
+	// Trigger is what caused the round to run.
+	Trigger GCTrigger
+
+	// Start is the time at which the round started.
+	Start time.Time
+
+	// Duration is how long the round took.
+	Duration time.Duration
+
+	// DiscardRatio is the discard ratio the round ran with.
+	DiscardRatio float64
+
+	// Err is the error the round finished with. badger.ErrNoRewrite means
+	// there was nothing worth collecting and badger.ErrRejected means
+	// another GC was already running.
+	Err error
+
+	// VlogBefore and VlogAfter are the sizes of the value log, in bytes,
+	// before and after the round.
+	VlogBefore int64
+	VlogAfter  int64
+}
+
+// Reclaimed returns the number of value log bytes freed by the round.
+func (r GCRound) Reclaimed() int64 {
+	return r.VlogBefore - r.VlogAfter
+}
+
+// Outcome returns how the round ended.
+func (r GCRound) Outcome() GCOutcome {
+	switch r.Err {
+	case nil:
+		return GCRewrote
+	case badger.ErrNoRewrite:
+		return GCNoRewrite
+	case badger.ErrRejected:
+		return GCRejected
+	default:
+		return GCFailed
+	}
+}
+
+// GCStats summarizes the garbage collection activity of a Datastore since it
+// was opened.
+type GCStats struct {
+	// Rounds is the total number of GC rounds run.
+	Rounds uint64
+
+	// NoRewriteRounds is the number of rounds that found nothing to
+	// collect (badger.ErrNoRewrite).
+	NoRewriteRounds uint64
+
+	// RejectedRounds is the number of rounds badger refused to run because
+	// another GC was in progress (badger.ErrRejected).
+	RejectedRounds uint64
+
+	// FailedRounds is the number of rounds that failed with any other
+	// error.
+	FailedRounds uint64
+
+	// Reclaimed is the total number of value log bytes freed by GC.
+	Reclaimed int64
+
+	// LastError is the error of the most recent failed round, if any.
+	LastError error
+
+	// DiskPressureEvents is the number of times free disk space dropped
+	// below GcDiskFreeThreshold.
+	DiskPressureEvents uint64
+
+	// UnderDiskPressure is true while free disk space is below
+	// GcDiskFreeThreshold.
+	UnderDiskPressure bool
+
+	// History holds the most recent rounds, oldest first.
+	History []GCRound
+}
+
+// GCStats returns statistics about the value log garbage collection performed
+// by this datastore, both by the periodic GC and by CollectGarbage.
+func (d *Datastore) GCStats() GCStats {
+	d.gcStatsLk.Lock()
+	defer d.gcStatsLk.Unlock()
+
+	stats := d.gcStats
+	stats.History = make([]GCRound, 0, len(d.gcStats.History))
+	// The history is a ring buffer, gcHistoryPos points at the oldest
+	// entry once it's full.
+	stats.History = append(stats.History, d.gcStats.History[d.gcHistoryPos:]...)
+	stats.History = append(stats.History, d.gcStats.History[:d.gcHistoryPos]...)
+	return stats
+}
+
+func (d *Datastore) recordGCRound(round GCRound) {
+	d.gcStatsLk.Lock()
+	defer d.gcStatsLk.Unlock()
+
+	s := &d.gcStats
+	s.Rounds++
+	switch round.Outcome() {
+	case GCNoRewrite:
+		s.NoRewriteRounds++
+	case GCRejected:
+		s.RejectedRounds++
+	case GCFailed:
+		s.FailedRounds++
+		s.LastError = round.Err
+	}
+	s.Reclaimed += round.Reclaimed()
+
+	if len(s.History) < gcHistorySize {
+		s.History = append(s.History, round)
+		return
+	}
+	s.History[d.gcHistoryPos] = round
+	d.gcHistoryPos = (d.gcHistoryPos + 1) % gcHistorySize
+}
+
+// diskUsage returns the current size of the LSM tree and value log files in
+// bytes.
+//
+// We don't use DB.Size() here as badger only refreshes it once a minute,
+// which is far too coarse to see what a single GC round did.
+func (d *Datastore) diskUsage() (lsm, vlog int64) {
+	err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".sst":
+			lsm += info.Size()
+		case ".vlog":
+			vlog += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf("failed to compute disk usage: %s", err)
+	}
+	return lsm, vlog
+}
+
+// vlogSize returns the current size of the value log files in bytes.
+func (d *Datastore) vlogSize() int64 {
+	_, vlog := d.diskUsage()
+	return vlog
+}
+
+// escalateDiscardRatio returns the discard ratio to retry with after a round
+// at discardRatio found nothing to collect, or 0 if there is no need to: the
+// datastore is within its target size or the ratio can't go any lower.
+func (d *Datastore) escalateDiscardRatio(opts GCOptions, discardRatio float64) float64 {
+	if opts.TargetSize <= 0 || discardRatio <= opts.MinDiscardRatio {
+		return 0
+	}
+	if lsm, vlog := d.diskUsage(); lsm+vlog <= opts.TargetSize {
+		return 0
+	}
+	return max(discardRatio/2, opts.MinDiscardRatio)
+}
+
+const (
+	// defaultGcMinInterval is how often write volume is checked when GC
+	// is driven by it and no GcMinInterval was set.
+	defaultGcMinInterval = time.Minute
+
+	// defaultGcDiskCheckInterval is how often free disk space is checked
+	// if no GcDiskCheckInterval was set.
+	defaultGcDiskCheckInterval = 10 * time.Second
+
+	// defaultGcMinDiscardRatio is the lowest discard ratio GC escalates to
+	// if no GcMinDiscardRatio was set.
+	defaultGcMinDiscardRatio = 0.01
+
+	// minGcGrowthBase is the smallest value log size growth is measured
+	// against, so that a small or empty value log can grow enough to
+	// start a cycle.
+	minGcGrowthBase = 1 << 20
+)
+
+// GCOptions are the garbage collection settings that can be changed while the
+// datastore is open. See the corresponding Gc* fields of Options.
+type GCOptions struct {
+	DiscardRatio float64
+	Interval     time.Duration
+	Sleep        time.Duration
+
+	ChurnThreshold int64
+	GrowthRatio    float64
+	MinInterval    time.Duration
+	MaxInterval    time.Duration
+
+	MinDiscardRatio float64
+	TargetSize      int64
+
+	Schedule            GCSchedule
+	CollectOnWindowOpen bool
+}
+
+func (o GCOptions) withDefaults() GCOptions {
+	if o.adaptive() && o.MinInterval <= 0 {
+		o.MinInterval = defaultGcMinInterval
+	}
+	if o.Sleep <= 0 {
+		// If Sleep is 0, we don't perform multiple rounds of GC per
+		// cycle.
+		o.Sleep = o.cycleInterval()
+	}
+	if o.MinDiscardRatio <= 0 {
+		o.MinDiscardRatio = min(defaultGcMinDiscardRatio, o.DiscardRatio)
+	}
+	return o
+}
+
+// adaptive returns true if GC cycles are driven by write volume rather than
+// a fixed interval.
+func (o GCOptions) adaptive() bool {
+	return o.ChurnThreshold > 0 || o.GrowthRatio > 0
+}
+
+// cycleInterval returns how long the periodic GC waits between cycles, or
+// between checks of the write volume in adaptive mode.
+func (o GCOptions) cycleInterval() time.Duration {
+	if o.adaptive() {
+		return o.MinInterval
+	}
+	return o.Interval
+}
+
+// GCOptions returns the garbage collection settings as they were given when
+// opening the datastore or to SetGCOptions, with zero fields standing for
+// their defaults, so that they can be changed and set again.
+func (d *Datastore) GCOptions() GCOptions {
+	d.gcLk.Lock()
+	defer d.gcLk.Unlock()
+	return d.gcOpts
+}
+
+// currentGCOptions returns the garbage collection settings in use, with the
+// defaults applied.
+func (d *Datastore) currentGCOptions() GCOptions {
+	return d.GCOptions().withDefaults()
+}
+
+// SetGCOptions changes the garbage collection settings of an open datastore.
+// The periodic GC restarts its wait using the new interval; a round that is
+// already running is not affected.
+func (d *Datastore) SetGCOptions(opts GCOptions) error {
+	if opts.DiscardRatio <= 0 || opts.DiscardRatio >= 1 {
+		return fmt.Errorf("gc discard ratio must be between 0 and 1, got %v", opts.DiscardRatio)
+	}
+	if opts.MinDiscardRatio < 0 || opts.MinDiscardRatio > opts.DiscardRatio {
+		return fmt.Errorf("gc minimum discard ratio must be between 0 and %v, got %v", opts.DiscardRatio, opts.MinDiscardRatio)
+	}
+
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+
+	d.gcLk.Lock()
+	d.gcOpts = opts
+	d.gcLk.Unlock()
+	d.trackChurn.Store(opts.adaptive())
+
+	d.wakeGC()
+	return nil
+}
+
+// PauseGC stops the periodic GC until ResumeGC is called. A round that is
+// already running finishes normally. Explicit calls to CollectGarbage are
+// not affected.
+func (d *Datastore) PauseGC() {
+	d.gcLk.Lock()
+	d.gcPaused = true
+	d.gcLk.Unlock()
+
+	d.wakeGC()
+}
+
+// ResumeGC restarts the periodic GC after PauseGC. The next cycle runs one
+// full interval after resuming.
+func (d *Datastore) ResumeGC() {
+	d.gcLk.Lock()
+	d.gcPaused = false
+	d.gcLk.Unlock()
+
+	d.wakeGC()
+}
+
+func (d *Datastore) wakeGC() {
+	select {
+	case d.gcWake <- struct{}{}:
+	default:
+		// Already pending.
+	}
+}
+
+// resetGCTimer arms the GC timer to fire after wait, or leaves it stopped if
+// the periodic GC is paused or disabled.
+func (d *Datastore) resetGCTimer(t *time.Timer, wait time.Duration) {
+	t.Stop()
+
+	d.gcLk.Lock()
+	idle := d.gcPaused || d.gcOpts.withDefaults().cycleInterval() <= 0
+	d.gcLk.Unlock()
+
+	if !idle {
+		t.Reset(wait)
+	}
+}
+
+// addChurn accounts for n bytes written or deleted, if GC is driven by write
+// volume.
+func (d *Datastore) addChurn(n int64) {
+	if n != 0 && d.trackChurn.Load() {
+		d.churn.Add(n)
+	}
+}
+
+// deletedSize returns the number of bytes freed by deleting key. The lookup
+// happens in its own read-only transaction so that it doesn't add the key to
+// the read set, and thus conflict detection, of the deleting transaction.
+func (d *Datastore) deletedSize(key []byte) int64 {
+	size := int64(len(key))
+	d.DB.View(func(txn *badger.Txn) error {
+		if item, err := txn.Get(key); err == nil {
+			size += item.ValueSize()
+		}
+		return nil
+	})
+	return size
+}
+
+// gcDue reports whether enough has been written since the last GC cycle, at
+// lastCycle with a value log of lastVlog bytes, to start a new one.
+func (d *Datastore) gcDue(opts GCOptions, lastCycle time.Time, lastVlog int64) bool {
+	if opts.MaxInterval > 0 && time.Since(lastCycle) >= opts.MaxInterval {
+		return true
+	}
+	if opts.ChurnThreshold > 0 && d.churn.Load() >= opts.ChurnThreshold {
+		return true
+	}
+	if opts.GrowthRatio > 0 {
+		base := max(lastVlog, minGcGrowthBase)
+		growth := float64(d.vlogSize()-lastVlog) / float64(base)
+		if growth >= opts.GrowthRatio {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep scheduling GC's AFTER `Interval` has passed since the previous GC, or
+// once enough has been written in adaptive mode, deferring to the next
+// maintenance window if there is a schedule.
+func (d *Datastore) periodicGC() {
+	gcTimeout := time.NewTimer(0)
+	d.resetGCTimer(gcTimeout, d.currentGCOptions().cycleInterval())
+	defer gcTimeout.Stop()
+
+	// State of the current cycle.
+	inCycle := false
+	var discardRatio float64
+
+	// State of the adaptive mode.
+	lastCycle := time.Now()
+	lastVlog := d.vlogSize()
+
+	// Whether a cycle is waiting for a maintenance window to open.
+	deferred := false
+
+	endCycle := func(opts GCOptions) {
+		inCycle = false
+		d.churn.Store(0)
+		lastCycle = time.Now()
+		lastVlog = d.vlogSize()
+		d.resetGCTimer(gcTimeout, opts.cycleInterval())
+	}
+
+	for {
+		select {
+		case <-gcTimeout.C:
+			opts := d.currentGCOptions()
+			if !inCycle && opts.adaptive() && !d.gcDue(opts, lastCycle, lastVlog) {
+				d.resetGCTimer(gcTimeout, opts.MinInterval)
+				continue
+			}
+
+			if opts.Schedule != nil {
+				now := time.Now()
+				start, end := opts.Schedule.Next(now)
+				if start.IsZero() {
+					log.Error("GC schedule has no upcoming window, skipping GC cycle")
+					endCycle(opts)
+					continue
+				}
+				if now.Before(start) {
+					log.Debugw("deferring GC until the next maintenance window", "start", start)
+					deferred = true
+					d.resetGCTimer(gcTimeout, start.Sub(now))
+					continue
+				}
+				if deferred && opts.CollectOnWindowOpen {
+					deferred = false
+					if d.collectUntil(end) == ErrClosed {
+						return
+					}
+					endCycle(opts)
+					continue
+				}
+				deferred = false
+			}
+
+			trigger := GCTriggerPeriodic
+			if opts.adaptive() {
+				trigger = GCTriggerAdaptive
+			}
+			if !inCycle {
+				discardRatio = opts.DiscardRatio
+			}
+			switch _, err := d.gcOnce(context.Background(), trigger, discardRatio); err {
+			case badger.ErrNoRewrite:
+				// No rewrite means we've fully garbage collected,
+				// at least at this discard ratio.
+				if next := d.escalateDiscardRatio(opts, discardRatio); next > 0 {
+					discardRatio = next
+					inCycle = true
+					d.resetGCTimer(gcTimeout, opts.Sleep)
+					continue
+				}
+			case badger.ErrRejected:
+				// Rejected means someone else is running a GC
+				// or we're closing.
+			case nil:
+				inCycle = true
+				d.resetGCTimer(gcTimeout, opts.Sleep)
+				continue
+			case ErrClosed:
+				return
+			default:
+				log.Errorf("error during a GC cycle: %s", err)
+				// Not much we can do on a random error but log it and continue.
+			}
+			endCycle(opts)
+		case <-d.gcWake:
+			d.resetGCTimer(gcTimeout, d.currentGCOptions().cycleInterval())
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+// collectUntil runs GC until there is nothing left to collect, the deadline
+// passes or the datastore is closed.
+func (d *Datastore) collectUntil(deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	log.Infow("maintenance window opened, collecting garbage", "until", deadline)
+	p, err := d.collectGarbage(ctx, GCTriggerPeriodic, nil)
+	switch err {
+	case nil, context.DeadlineExceeded:
+		log.Infow("finished maintenance window GC", "rounds", p.Rounds, "reclaimed", p.Reclaimed)
+	case context.Canceled:
+		return ErrClosed
+	case ErrClosed:
+		return err
+	default:
+		log.Errorf("error during maintenance window GC: %s", err)
+	}
+	return nil
+}
+
+// watchDiskPressure checks free disk space every interval and, while it is
+// below threshold, runs GC cycles with an increasingly aggressive discard
+// ratio. This happens even if the periodic GC is paused or outside of its
+// maintenance windows, running out of disk space is worse than a latency
+// spike.
+func (d *Datastore) watchDiskPressure(threshold float64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	underPressure := false
+	var discardRatio float64
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.closing:
+			return
+		}
+
+		free, total, err := diskFree(d.path)
+		if err != nil {
+			log.Errorf("failed to check free disk space, disabling disk pressure GC: %s", err)
+			return
+		}
+		freeRatio := float64(free) / float64(total)
+
+		if freeRatio >= threshold {
+			if underPressure {
+				log.Infow("disk pressure relieved", "free", free, "total", total)
+				underPressure = false
+				d.setDiskPressure(false)
+			}
+			continue
+		}
+
+		opts := d.currentGCOptions()
+		if !underPressure {
+			underPressure = true
+			discardRatio = opts.DiscardRatio
+			d.setDiskPressure(true)
+			log.Warnw("low disk space, running GC", "free", free, "total", total, "discardRatio", discardRatio)
+		} else {
+			// The last cycle didn't free enough, be more aggressive.
+			discardRatio = max(discardRatio/2, opts.MinDiscardRatio)
+			log.Warnw("still low on disk space, escalating GC", "free", free, "total", total, "discardRatio", discardRatio)
+		}
+
+		// Like periodic GC cycles, rounds are GcSleep apart, and there
+		// is a single round per check if it isn't set.
+		sleep := d.GCOptions().Sleep
+		for {
+			_, err := d.gcOnce(context.Background(), GCTriggerPressure, discardRatio)
+			if err != nil {
+				if err != badger.ErrNoRewrite && err != badger.ErrRejected && err != ErrClosed {
+					log.Errorf("error during a disk pressure GC cycle: %s", err)
+				}
+				break
+			}
+			if sleep <= 0 {
+				break
+			}
+			select {
+			case <-time.After(sleep):
+			case <-d.closing:
+				return
+			}
+		}
+	}
+}
+
+func (d *Datastore) setDiskPressure(underPressure bool) {
+	d.gcStatsLk.Lock()
+	defer d.gcStatsLk.Unlock()
+
+	if underPressure {
+		d.gcStats.DiskPressureEvents++
+	}
+	d.gcStats.UnderDiskPressure = underPressure
+}
+
+// GCProgress reports how far a CollectGarbage call got.
+type GCProgress struct {
+	// Rounds is the number of GC rounds that rewrote a value log file.
+	Rounds int
+
+	// Reclaimed is the number of value log bytes freed so far.
+	Reclaimed int64
+}
+
+// CollectGarbage runs value log GC rounds until there is nothing left to
+// collect or ctx is cancelled.
+func (d *Datastore) CollectGarbage(ctx context.Context) error {
+	_, err := d.CollectGarbageWithProgress(ctx, nil)
+	return err
+}
+
+// CollectGarbageWithProgress is like CollectGarbage but calls progress, if not
+// nil, after every round that rewrote a value log file and returns how much
+// work was done.
+//
+// Cancelling ctx stops the collection between rounds, in which case the
+// progress made so far is returned along with the context's error. A round
+// that has already started can't be interrupted.
+func (d *Datastore) CollectGarbageWithProgress(ctx context.Context, progress func(GCProgress)) (GCProgress, error) {
+	return d.collectGarbage(ctx, GCTriggerManual, progress)
+}
+
+func (d *Datastore) collectGarbage(ctx context.Context, trigger GCTrigger, progress func(GCProgress)) (GCProgress, error) {
+	var p GCProgress
+	opts := d.currentGCOptions()
+	discardRatio := opts.DiscardRatio
+	// The idea is to keep calling DB.RunValueLogGC() till Badger no longer has any log files
+	// to GC(which would be indicated by an error, please refer to Badger GC docs).
+	for {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+
+		round, err := d.gcOnce(ctx, trigger, discardRatio)
+		switch err {
+		case nil:
+		case badger.ErrNoRewrite:
+			next := d.escalateDiscardRatio(opts, discardRatio)
+			if next == 0 {
+				return p, nil
+			}
+			discardRatio = next
+			continue
+		default:
+			return p, err
+		}
+
+		p.Rounds++
+		p.Reclaimed += round.Reclaimed()
+		if progress != nil {
+			progress(p)
+		}
+	}
+}
+
+// gcOnce runs a single GC round, records it and reports it to the OnGC hook.
+// If the datastore shares a GCCoordinator, the round first waits for its turn
+// or for ctx to be cancelled.
+func (d *Datastore) gcOnce(ctx context.Context, trigger GCTrigger, discardRatio float64) (GCRound, error) {
+	if d.gcMember != nil {
+		if err := d.gcMember.acquire(ctx, d.closing); err != nil {
+			return GCRound{}, err
+		}
+		defer d.gcMember.release()
+	}
+
+	round, err := d.runGCRound(trigger, discardRatio)
+	if err != nil {
+		return round, err
+	}
+
+	d.recordGCRound(round)
+	if d.onGC != nil {
+		d.onGC(round)
+	}
+	return round, round.Err
+}
+
+func (d *Datastore) runGCRound(trigger GCTrigger, discardRatio float64) (GCRound, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return GCRound{}, ErrClosed
+	}
+	log.Infow("Running GC round", "trigger", trigger, "discardRatio", discardRatio)
+
+	round := GCRound{
+		Trigger:      trigger,
+		Start:        time.Now(),
+		DiscardRatio: discardRatio,
+		VlogBefore:   d.vlogSize(),
+	}
+	round.Err = d.DB.RunValueLogGC(discardRatio)
+	round.Duration = time.Since(round.Start)
+	round.VlogAfter = d.vlogSize()
+
+	log.Infow("Finished running GC round",
+		"duration", round.Duration,
+		"reclaimed", round.Reclaimed(),
+		"outcome", round.Outcome(),
+		"err", round.Err,
+	)
+	return round, nil
+}
@@ -0,0 +1,548 @@
+package badger
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// newGCTestDatastore opens a datastore with small value log files and no
+// periodic GC, so tests are in full control of when GC runs.
+func newGCTestDatastore(t *testing.T) *Datastore {
+	opts := DefaultOptions
+	opts.Options = badger.DefaultOptions("")
+	opts.ValueLogFileSize = 1 << 20
+	opts.GcInterval = 0
+
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// addGarbage writes count values and then deletes them again.
+func addGarbage(t *testing.T, d *Datastore, count int) {
+	b, err := d.Batch(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		buf := make([]byte, 6400)
+		rand.Read(buf)
+		if err := b.Put(bg, ds.NewKey(fmt.Sprintf("/key%d", i)), buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(bg); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = d.Batch(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := b.Delete(bg, ds.NewKey(fmt.Sprintf("/key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(bg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCStats(t *testing.T) {
+	d := newGCTestDatastore(t)
+
+	if stats := d.GCStats(); stats.Rounds != 0 || len(stats.History) != 0 {
+		t.Fatalf("expected empty stats, got %+v", stats)
+	}
+
+	addGarbage(t, d, 1000)
+
+	if err := d.CollectGarbage(bg); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := d.GCStats()
+	if stats.Rounds < 1 {
+		t.Fatalf("expected at least one round, got %d", stats.Rounds)
+	}
+	if stats.NoRewriteRounds != 1 {
+		t.Fatalf("expected exactly one no-rewrite round, got %d", stats.NoRewriteRounds)
+	}
+	if uint64(len(stats.History)) != stats.Rounds {
+		t.Fatalf("expected %d rounds in history, got %d", stats.Rounds, len(stats.History))
+	}
+	last := stats.History[len(stats.History)-1]
+	if last.Err != badger.ErrNoRewrite {
+		t.Fatalf("expected last round to be a no-rewrite, got %v", last.Err)
+	}
+	if last.VlogBefore <= 0 || last.Duration <= 0 {
+		t.Fatalf("expected round to record sizes and duration, got %+v", last)
+	}
+	if stats.LastError != nil {
+		t.Fatalf("unexpected error: %s", stats.LastError)
+	}
+}
+
+func TestGCStatsHistoryBounded(t *testing.T) {
+	d := newGCTestDatastore(t)
+
+	for i := 0; i < gcHistorySize+10; i++ {
+		d.recordGCRound(GCRound{VlogBefore: int64(i)})
+	}
+
+	stats := d.GCStats()
+	if stats.Rounds != gcHistorySize+10 {
+		t.Fatalf("expected %d rounds, got %d", gcHistorySize+10, stats.Rounds)
+	}
+	if len(stats.History) != gcHistorySize {
+		t.Fatalf("expected history of %d, got %d", gcHistorySize, len(stats.History))
+	}
+	for i, r := range stats.History {
+		if r.VlogBefore != int64(i+10) {
+			t.Fatalf("history out of order at %d: %d", i, r.VlogBefore)
+		}
+	}
+}
+
+func TestCollectGarbageCancelled(t *testing.T) {
+	d := newGCTestDatastore(t)
+	addGarbage(t, d, 1000)
+
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+
+	p, err := d.CollectGarbageWithProgress(ctx, func(GCProgress) {
+		t.Error("progress reported for a cancelled collection")
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if p.Rounds != 0 {
+		t.Fatalf("expected no rounds, got %d", p.Rounds)
+	}
+	if stats := d.GCStats(); stats.Rounds != 0 {
+		t.Fatalf("expected no GC rounds to run, got %d", stats.Rounds)
+	}
+
+	p, err = d.CollectGarbageWithProgress(bg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := d.GCStats(); stats.Rounds != uint64(p.Rounds)+1 {
+		t.Fatalf("expected %d rounds, got %d", p.Rounds+1, stats.Rounds)
+	}
+}
+
+// waitForGCRounds waits until at least n GC rounds have been recorded.
+func waitForGCRounds(t *testing.T, d *Datastore, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.GCStats().Rounds < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d GC rounds", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetGCOptions(t *testing.T) {
+	d := newGCTestDatastore(t)
+
+	if err := d.SetGCOptions(GCOptions{DiscardRatio: 1}); err == nil {
+		t.Fatal("expected an invalid discard ratio to be rejected")
+	}
+
+	err := d.SetGCOptions(GCOptions{
+		DiscardRatio: 0.5,
+		Interval:     10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := d.GCOptions()
+	if opts.DiscardRatio != 0.5 || opts.Interval != 10*time.Millisecond || opts.Sleep != 0 || opts.MinDiscardRatio != 0 {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	// The periodic GC was disabled at open time, it must pick up the
+	// new interval.
+	waitForGCRounds(t, d, 1)
+
+	// Defaults aren't carried over when changing the options.
+	opts.Interval = time.Hour
+	if err := d.SetGCOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if current := d.currentGCOptions(); current.Sleep != time.Hour {
+		t.Fatalf("expected the sleep to follow the interval, got %s", current.Sleep)
+	}
+
+	d.Close()
+	if err := d.SetGCOptions(opts); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPauseResumeGC(t *testing.T) {
+	d := newGCTestDatastore(t)
+
+	d.PauseGC()
+	err := d.SetGCOptions(GCOptions{
+		DiscardRatio: 0.5,
+		Interval:     10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if rounds := d.GCStats().Rounds; rounds != 0 {
+		t.Fatalf("expected no GC while paused, got %d rounds", rounds)
+	}
+
+	d.ResumeGC()
+	waitForGCRounds(t, d, 1)
+}
+
+func TestChurnTracking(t *testing.T) {
+	opts := DefaultOptions
+	opts.GcInterval = 0
+	opts.GcChurnThreshold = 1 << 40
+	opts.GcMinInterval = time.Hour
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	key := ds.NewKey("/a")
+	value := make([]byte, 100)
+	entrySize := int64(len(key.String()) + len(value))
+
+	if err := d.Put(bg, key, value); err != nil {
+		t.Fatal(err)
+	}
+	if churn := d.churn.Load(); churn != entrySize {
+		t.Fatalf("expected churn of %d after put, got %d", entrySize, churn)
+	}
+
+	if err := d.Delete(bg, key); err != nil {
+		t.Fatal(err)
+	}
+	if churn := d.churn.Load(); churn != 2*entrySize {
+		t.Fatalf("expected churn of %d after delete, got %d", 2*entrySize, churn)
+	}
+
+	b, err := d.Batch(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(bg, key, value); err != nil {
+		t.Fatal(err)
+	}
+	if churn := d.churn.Load(); churn != 2*entrySize {
+		t.Fatal("uncommitted batch writes must not be counted")
+	}
+	if err := b.Commit(bg); err != nil {
+		t.Fatal(err)
+	}
+	if churn := d.churn.Load(); churn != 3*entrySize {
+		t.Fatalf("expected churn of %d after batch, got %d", 3*entrySize, churn)
+	}
+
+	txn, err := d.NewTransaction(bg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(bg, key, value); err != nil {
+		t.Fatal(err)
+	}
+	txn.Discard(bg)
+	if churn := d.churn.Load(); churn != 3*entrySize {
+		t.Fatal("discarded transaction writes must not be counted")
+	}
+}
+
+func TestAdaptiveGC(t *testing.T) {
+	opts := DefaultOptions
+	opts.GcInterval = 0
+	opts.GcChurnThreshold = 10000
+	opts.GcMinInterval = 10 * time.Millisecond
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if rounds := d.GCStats().Rounds; rounds != 0 {
+		t.Fatalf("expected no GC without writes, got %d rounds", rounds)
+	}
+
+	if err := d.Put(bg, ds.NewKey("/big"), make([]byte, 20000)); err != nil {
+		t.Fatal(err)
+	}
+	waitForGCRounds(t, d, 1)
+
+	// Churn starts over after a cycle.
+	time.Sleep(100 * time.Millisecond)
+	if churn := d.churn.Load(); churn != 0 {
+		t.Fatalf("expected churn to be reset, got %d", churn)
+	}
+	if rounds := d.GCStats().Rounds; rounds != 1 {
+		t.Fatalf("expected a single GC round, got %d", rounds)
+	}
+}
+
+func TestGrowthGCFromEmpty(t *testing.T) {
+	opts := DefaultOptions
+	opts.GcInterval = 0
+	opts.GcGrowthRatio = 0.1
+	opts.GcMinInterval = 50 * time.Millisecond
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if rounds := d.GCStats().Rounds; rounds != 0 {
+		t.Fatalf("expected no GC without writes, got %d rounds", rounds)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := d.Put(bg, ds.NewKey(fmt.Sprintf("/big%d", i)), make([]byte, 1<<20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForGCRounds(t, d, 1)
+}
+
+func TestDiskPressureGC(t *testing.T) {
+	opts := DefaultOptions
+	opts.GcInterval = 0
+	// There is always less than 100% free space, so we're permanently
+	// under pressure.
+	opts.GcDiskFreeThreshold = 1
+	opts.GcDiskCheckInterval = 10 * time.Millisecond
+	opts.GcMinDiscardRatio = 0.05
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	waitForGCRounds(t, d, 4)
+
+	stats := d.GCStats()
+	if !stats.UnderDiskPressure || stats.DiskPressureEvents != 1 {
+		t.Fatalf("expected a single ongoing disk pressure event, got %+v", stats)
+	}
+
+	expected := []float64{0.2, 0.1, 0.05, 0.05}
+	for i, ratio := range expected {
+		if got := stats.History[i].DiscardRatio; got != ratio {
+			t.Fatalf("expected round %d to use discard ratio %v, got %v", i, ratio, got)
+		}
+	}
+}
+
+func TestDiskPressureGCSleep(t *testing.T) {
+	var (
+		lk     sync.Mutex
+		rounds []GCRound
+	)
+	opts := DefaultOptions
+	opts.Options = badger.DefaultOptions("")
+	opts.ValueLogFileSize = 1 << 20
+	// Small memtables are flushed often, so that value log files can be
+	// collected.
+	opts.MaxTableSize = 1 << 14
+	opts.GcInterval = 0
+	opts.GcSleep = 100 * time.Millisecond
+	opts.GcDiskFreeThreshold = 1
+	opts.GcDiskCheckInterval = 10 * time.Millisecond
+	opts.OnGC = func(round GCRound) {
+		lk.Lock()
+		rounds = append(rounds, round)
+		lk.Unlock()
+	}
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 3; i++ {
+		addGarbage(t, d, 500)
+	}
+
+	// Wait for a round collecting garbage, followed by another one.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for disk pressure GC rounds")
+		}
+		lk.Lock()
+		done := false
+		for i := 0; i+1 < len(rounds); i++ {
+			if rounds[i].Err == nil {
+				done = true
+			}
+		}
+		lk.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	for i := 1; i < len(rounds); i++ {
+		if rounds[i-1].Err != nil {
+			continue
+		}
+		if gap := rounds[i].Start.Sub(rounds[i-1].Start); gap < opts.GcSleep {
+			t.Fatalf("expected rounds %d and %d to be %s apart, got %s", i-1, i, opts.GcSleep, gap)
+		}
+	}
+}
+
+// fixedWindow is a GCSchedule with a single window.
+type fixedWindow struct {
+	start, end time.Time
+}
+
+func (w fixedWindow) Next(t time.Time) (time.Time, time.Time) {
+	if t.Before(w.end) {
+		return w.start, w.end
+	}
+	return time.Time{}, time.Time{}
+}
+
+func TestScheduledGC(t *testing.T) {
+	start := time.Now().Add(200 * time.Millisecond)
+
+	opts := DefaultOptions
+	opts.GcInterval = 10 * time.Millisecond
+	opts.GcSchedule = fixedWindow{start, start.Add(time.Hour)}
+	opts.GcCollectOnWindowOpen = true
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if rounds := d.GCStats().Rounds; rounds != 0 {
+		t.Fatalf("expected no GC outside of the window, got %d rounds", rounds)
+	}
+
+	waitForGCRounds(t, d, 1)
+	if first := d.GCStats().History[0].Start; first.Before(start) {
+		t.Fatalf("GC ran at %s, before the window opened at %s", first, start)
+	}
+}
+
+func TestOnGC(t *testing.T) {
+	rounds := make(chan GCRound, 100)
+
+	opts := DefaultOptions
+	opts.GcInterval = 0
+	opts.OnGC = func(r GCRound) {
+		rounds <- r
+	}
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.CollectGarbage(bg); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-rounds
+	if r.Trigger != GCTriggerManual {
+		t.Fatalf("expected a manual round, got %s", r.Trigger)
+	}
+	if r.Outcome() != GCNoRewrite {
+		t.Fatalf("expected a no-rewrite outcome, got %s", r.Outcome())
+	}
+	if r.DiscardRatio != opts.GcDiscardRatio {
+		t.Fatalf("expected discard ratio %v, got %v", opts.GcDiscardRatio, r.DiscardRatio)
+	}
+
+	err = d.SetGCOptions(GCOptions{
+		DiscardRatio: 0.3,
+		Interval:     10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r = <-rounds:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a periodic round")
+	}
+	if r.Trigger != GCTriggerPeriodic || r.DiscardRatio != 0.3 {
+		t.Fatalf("expected a periodic round with the new ratio, got %s at %v", r.Trigger, r.DiscardRatio)
+	}
+}
+
+func TestDiscardRatioEscalation(t *testing.T) {
+	opts := DefaultOptions
+	opts.GcInterval = 0
+	opts.GcMinDiscardRatio = 0.05
+	// Any datastore is bigger than this.
+	opts.GcTargetSize = 1
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	if err := d.CollectGarbage(bg); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := d.GCStats()
+	expected := []float64{0.2, 0.1, 0.05}
+	if len(stats.History) != len(expected) {
+		t.Fatalf("expected %d rounds, got %d", len(expected), len(stats.History))
+	}
+	for i, ratio := range expected {
+		if got := stats.History[i].DiscardRatio; got != ratio {
+			t.Fatalf("expected round %d to use discard ratio %v, got %v", i, ratio, got)
+		}
+	}
+
+	// Without a target, a single no-rewrite round ends the collection.
+	gcOpts := d.GCOptions()
+	gcOpts.TargetSize = 0
+	if err := d.SetGCOptions(gcOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CollectGarbage(bg); err != nil {
+		t.Fatal(err)
+	}
+	if rounds := d.GCStats().Rounds; rounds != 4 {
+		t.Fatalf("expected a single extra round, got %d", rounds-3)
+	}
+}
@@ -0,0 +1,323 @@
+package badger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// Layout of the value log entries written by badger: a header holding the
+// key length, value length, expiration and two meta bytes, followed by the
+// key (with its version appended), the value and a CRC32 (Castagnoli) of
+// everything before it.
+const (
+	vlogHeaderSize = 18
+	vlogMaxKeySize = 1 << 16
+)
+
+var (
+	vlogCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// Internal keys written by badger.
+	badgerInternalPrefix = []byte("!badger!")
+	badgerMovePrefix     = []byte("!badger!move")
+)
+
+// VlogEstimate is the estimated garbage in a single value log file.
+type VlogEstimate struct {
+	// Fid is the id of the value log file, as found in its name.
+	Fid uint32
+	// Size of the file, in bytes.
+	Size int64
+
+	// Number of entries and bytes sampled, and how many of those bytes
+	// could be discarded.
+	SampledEntries   int
+	SampledBytes     int64
+	DiscardableBytes int64
+
+	// Active is set for the file currently being written to, which GC
+	// never rewrites.
+	Active bool
+
+	// WouldRewrite is set if a GC round picking this file with the
+	// current discard ratio would rewrite it.
+	WouldRewrite bool
+}
+
+// DiscardRatio returns the fraction of the sampled bytes that could be
+// discarded.
+func (e VlogEstimate) DiscardRatio() float64 {
+	if e.SampledBytes == 0 {
+		return 0
+	}
+	return float64(e.DiscardableBytes) / float64(e.SampledBytes)
+}
+
+// Discardable extrapolates the sample to the whole file.
+func (e VlogEstimate) Discardable() int64 {
+	return int64(e.DiscardRatio() * float64(e.Size))
+}
+
+// GCEstimate is the result of EstimateGarbage.
+type GCEstimate struct {
+	// DiscardRatio the estimate was made with.
+	DiscardRatio float64
+	// Files, ordered by fid.
+	Files []VlogEstimate
+}
+
+// Discardable returns the estimated number of discardable bytes across all
+// value log files.
+func (e GCEstimate) Discardable() int64 {
+	var total int64
+	for _, f := range e.Files {
+		total += f.Discardable()
+	}
+	return total
+}
+
+// Reclaimable returns the estimated number of bytes GC would free with the
+// current discard ratio, that is the size of the files it would rewrite
+// minus what they still hold.
+func (e GCEstimate) Reclaimable() int64 {
+	var total int64
+	for _, f := range e.Files {
+		if f.WouldRewrite {
+			total += f.Discardable()
+		}
+	}
+	return total
+}
+
+// EstimateGarbage samples every value log file the way GC does and
+// estimates how much of it could be discarded, without rewriting anything.
+// As GC, it samples a random window of each file so results vary slightly
+// between calls.
+func (d *Datastore) EstimateGarbage(ctx context.Context) (GCEstimate, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return GCEstimate{}, ErrClosed
+	}
+
+	estimate := GCEstimate{DiscardRatio: d.currentGCOptions().DiscardRatio}
+	fids, err := d.vlogFids()
+	if err != nil {
+		return GCEstimate{}, err
+	}
+
+	txn := d.DB.NewTransaction(false)
+	defer txn.Discard()
+	for i, fid := range fids {
+		if err := ctx.Err(); err != nil {
+			return GCEstimate{}, err
+		}
+		f, err := d.estimateVlog(ctx, txn, fid, estimate.DiscardRatio)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Rewritten and removed by GC since the files were listed.
+			continue
+		}
+		if err != nil {
+			return GCEstimate{}, err
+		}
+		f.Active = i == len(fids)-1
+		f.WouldRewrite = !f.Active && f.WouldRewrite
+		estimate.Files = append(estimate.Files, f)
+	}
+	return estimate, nil
+}
+
+// vlogFids returns the ids of the value log files, in increasing order.
+func (d *Datastore) vlogFids() ([]uint32, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var fids []uint32
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".vlog")
+		if !ok {
+			continue
+		}
+		fid, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			continue
+		}
+		fids = append(fids, uint32(fid))
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids, nil
+}
+
+// estimateVlog samples a value log file with the same window sizes as GC:
+// 10% of the file or 1% of ValueLogMaxEntries, whichever comes first.
+func (d *Datastore) estimateVlog(ctx context.Context, txn *badger.Txn, fid uint32, discardRatio float64) (VlogEstimate, error) {
+	est := VlogEstimate{Fid: fid}
+	f, err := os.Open(filepath.Join(d.path, fmt.Sprintf("%06d.vlog", fid)))
+	if err != nil {
+		return est, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return est, err
+	}
+	est.Size = fi.Size()
+	if est.Size == 0 {
+		return est, nil
+	}
+
+	sizeWindow := est.Size / 10
+	countWindow := int(d.vlogMaxEntries / 100)
+	skip := rand.Int63n(est.Size) - sizeWindow
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for est.SampledEntries <= countWindow && est.SampledBytes <= sizeWindow {
+		if err := ctx.Err(); err != nil {
+			return est, err
+		}
+		if offset < skip {
+			// Entries before the window are only skipped over.
+			n, err := skipVlogEntry(r, est.Size-offset)
+			if err != nil {
+				break
+			}
+			offset += n
+			continue
+		}
+		key, value, expiresAt, n, err := readVlogEntry(r, est.Size-offset)
+		if err != nil {
+			// Stop at the end of the file, or at the first entry that was
+			// only partially written.
+			break
+		}
+		offset += n
+
+		discard, err := d.discardable(txn, key, value, expiresAt)
+		if err != nil {
+			return est, err
+		}
+		est.SampledEntries++
+		est.SampledBytes += n
+		if discard {
+			est.DiscardableBytes += n
+		}
+	}
+
+	// GC skips files it couldn't sample enough of.
+	sampledEnough := est.SampledEntries >= countWindow || float64(est.SampledBytes) >= float64(sizeWindow)*0.75
+	est.WouldRewrite = sampledEnough && est.DiscardRatio() >= discardRatio
+	return est, nil
+}
+
+var errVlogCorrupt = errors.New("corrupt value log entry")
+
+// readVlogHeader reads the header of the next value log entry, returning it
+// along with the lengths of the key and value following it. remaining is the
+// number of bytes left in the file.
+func readVlogHeader(r *bufio.Reader, remaining int64) (header [vlogHeaderSize]byte, klen, vlen uint32, err error) {
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return header, 0, 0, err
+	}
+	klen = binary.BigEndian.Uint32(header[0:4])
+	vlen = binary.BigEndian.Uint32(header[4:8])
+	if klen > vlogMaxKeySize || klen <= 8 || int64(klen)+int64(vlen) > remaining {
+		return header, 0, 0, errVlogCorrupt
+	}
+	return header, klen, vlen, nil
+}
+
+// skipVlogEntry skips over the next value log entry without reading its key
+// and value or checking its checksum, returning its encoded size.
+func skipVlogEntry(r *bufio.Reader, remaining int64) (int64, error) {
+	_, klen, vlen, err := readVlogHeader(r, remaining)
+	if err != nil {
+		return 0, err
+	}
+	n := int(klen) + int(vlen) + crc32.Size
+	if _, err := r.Discard(n); err != nil {
+		return 0, err
+	}
+	return int64(vlogHeaderSize + n), nil
+}
+
+// readVlogEntry reads the next value log entry, returning its key (with the
+// version), value, expiration and encoded size. remaining is the number of
+// bytes left in the file.
+func readVlogEntry(r *bufio.Reader, remaining int64) (key, value []byte, expiresAt uint64, n int64, err error) {
+	header, klen, vlen, err := readVlogHeader(r, remaining)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	expiresAt = binary.BigEndian.Uint64(header[8:16])
+
+	hash := crc32.New(vlogCrcTable)
+	hash.Write(header[:])
+	tee := io.TeeReader(r, hash)
+	key = make([]byte, klen)
+	if _, err = io.ReadFull(tee, key); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	value = make([]byte, vlen)
+	if _, err = io.ReadFull(tee, value); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	var crc [crc32.Size]byte
+	if _, err = io.ReadFull(r, crc[:]); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if binary.BigEndian.Uint32(crc[:]) != hash.Sum32() {
+		return nil, nil, 0, 0, errVlogCorrupt
+	}
+	n = int64(vlogHeaderSize) + int64(klen) + int64(vlen) + crc32.Size
+	return key, value, expiresAt, n, nil
+}
+
+// discardable tells whether GC could drop a value log entry: it has been
+// overwritten, deleted or has expired, its value is kept in the LSM tree, or
+// it is a transaction marker.
+func (d *Datastore) discardable(txn *badger.Txn, key, value []byte, expiresAt uint64) (bool, error) {
+	version := math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-8:])
+	key = key[:len(key)-8]
+
+	if bytes.HasPrefix(key, badgerMovePrefix) {
+		// Moved by a previous GC, check the entry it was moved for.
+		key = key[len(badgerMovePrefix):]
+	} else if bytes.HasPrefix(key, badgerInternalPrefix) {
+		return true, nil
+	}
+	if expiresAt != 0 && expiresAt <= uint64(time.Now().Unix()) {
+		return true, nil
+	}
+	if len(value) < d.valueThreshold {
+		return true, nil
+	}
+
+	item, err := txn.Get(key)
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return true, nil
+	default:
+		return false, err
+	}
+	return item.Version() != version || item.IsDeletedOrExpired(), nil
+}
@@ -0,0 +1,139 @@
+package badger
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestEstimateGarbage(t *testing.T) {
+	d := newGCTestDatastore(t)
+
+	// Live data only, nothing to discard but the transaction markers.
+	for i := 0; i < 500; i++ {
+		buf := make([]byte, 6400)
+		rand.Read(buf)
+		if err := d.Put(bg, ds.NewKey(fmt.Sprintf("/live%d", i)), buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	est, err := d.EstimateGarbage(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(est.Files) < 2 {
+		t.Fatalf("expected several value log files, got %d", len(est.Files))
+	}
+	for i, f := range est.Files {
+		if f.Active != (i == len(est.Files)-1) {
+			t.Fatalf("only the last file should be active: %+v", est.Files)
+		}
+		if f.SampledEntries == 0 && f.Size > 0 {
+			t.Fatalf("file %d wasn't sampled", f.Fid)
+		}
+		// The transaction markers are garbage, but a small sample can
+		// make them a large part of it.
+		if f.DiscardableBytes >= 6400 || f.WouldRewrite {
+			t.Fatalf("expected no garbage in file %d: %+v", f.Fid, f)
+		}
+	}
+	if est.Reclaimable() != 0 {
+		t.Fatalf("expected nothing to reclaim, got %d", est.Reclaimable())
+	}
+
+	// Delete everything.
+	for i := 0; i < 500; i++ {
+		if err := d.Delete(bg, ds.NewKey(fmt.Sprintf("/live%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addGarbage(t, d, 500)
+
+	vlogBefore := d.vlogSize()
+	est, err = d.EstimateGarbage(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.DiscardRatio != d.GCOptions().DiscardRatio {
+		t.Fatalf("expected the current discard ratio, got %f", est.DiscardRatio)
+	}
+	for _, f := range est.Files {
+		if f.Active {
+			continue
+		}
+		if f.DiscardRatio() != 1 || !f.WouldRewrite {
+			t.Fatalf("expected file %d to be all garbage: %+v", f.Fid, f)
+		}
+	}
+	if est.Reclaimable() <= 0 || est.Discardable() < est.Reclaimable() {
+		t.Fatalf("unexpected totals: %d discardable, %d reclaimable", est.Discardable(), est.Reclaimable())
+	}
+	if d.vlogSize() != vlogBefore {
+		t.Fatal("estimating garbage shouldn't change the value log")
+	}
+
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+	if _, err := d.EstimateGarbage(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	d.Close()
+	if _, err := d.EstimateGarbage(bg); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSkipVlogEntry(t *testing.T) {
+	d := newGCTestDatastore(t)
+	addGarbage(t, d, 100)
+
+	fids, err := d.vlogFids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(d.path, fmt.Sprintf("%06d.vlog", fids[0]))
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := func(read func(r *bufio.Reader, remaining int64) (int64, error)) []int64 {
+		t.Helper()
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		r := bufio.NewReader(f)
+		var sizes []int64
+		var offset int64
+		for {
+			n, err := read(r, fi.Size()-offset)
+			if err != nil {
+				return sizes
+			}
+			sizes = append(sizes, n)
+			offset += n
+		}
+	}
+	read := sizes(func(r *bufio.Reader, remaining int64) (int64, error) {
+		_, _, _, n, err := readVlogEntry(r, remaining)
+		return n, err
+	})
+	skipped := sizes(skipVlogEntry)
+	if len(read) < 2 || len(read) != len(skipped) {
+		t.Fatalf("expected the same entries, read %d and skipped %d", len(read), len(skipped))
+	}
+	for i := range read {
+		if read[i] != skipped[i] {
+			t.Fatalf("entry %d: read %d bytes, skipped %d", i, read[i], skipped[i])
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	badger "github.com/dgraph-io/badger"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrUnknownIndex is returned when using an index that isn't registered.
+var ErrUnknownIndex = errors.New("unknown index")
+
+// indexNamespace prefixes the keys of index entries. Datastore keys all
+// start with a slash, which sorts after it, so queries never see them.
+const indexNamespace = "!index!"
+
+// Index is a secondary index over the entries under a prefix, mapping the
+// values extracted from them back to their keys. See RegisterIndex.
+type Index struct {
+	// Name identifies the index. It can't be empty or contain slashes.
+	Name string
+	// Prefix of the keys to index, like the prefix of a query.
+	Prefix ds.Key
+	// Extract returns the values an entry is indexed under, none to leave
+	// it out of the index. It must always return the same values for the
+	// same entry, as they're extracted again from the previous value of
+	// entries being overwritten or deleted, to remove them from the index.
+	Extract func(key ds.Key, value []byte) [][]byte
+}
+
+// RegisterIndex registers an index, keeping it up to date on every write
+// from now on. The index entries are written in the same transaction as
+// the entries they're extracted from, and batches write every entry with
+// its index entries in the same transaction.
+//
+// Indexes aren't persisted: they must be registered every time the
+// datastore is opened, before writing to it. Entries written while an
+// index isn't registered aren't indexed, see RebuildIndex.
+//
+// Writing to an indexed key reads its previous value, so concurrent
+// transactions writing to the same key conflict. Put, PutWithTTL and Delete
+// retry on conflicts.
+func (d *Datastore) RegisterIndex(idx Index) error {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+
+	if idx.Name == "" || strings.Contains(idx.Name, "/") {
+		return fmt.Errorf("invalid index name %q", idx.Name)
+	}
+	if idx.Extract == nil {
+		return fmt.Errorf("index %s has no extractor", idx.Name)
+	}
+
+	d.indexLk.Lock()
+	defer d.indexLk.Unlock()
+	if _, ok := d.indexes[idx.Name]; ok {
+		return fmt.Errorf("index %s already registered", idx.Name)
+	}
+	if d.indexes == nil {
+		d.indexes = make(map[string]Index)
+	}
+	d.indexes[idx.Name] = idx
+	return nil
+}
+
+// LookupIndex returns the keys of the entries indexed under value, in key
+// order.
+func (d *Datastore) LookupIndex(ctx context.Context, name string, value []byte) ([]ds.Key, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	if _, ok := d.index(name); !ok {
+		return nil, ErrUnknownIndex
+	}
+
+	txn := d.newImplicitTransaction(true)
+	defer txn.discard()
+
+	prefix := indexValuePrefix(name, value)
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.Prefix = prefix
+	it := txn.txn.NewIterator(opt)
+	defer it.Close()
+
+	var keys []ds.Key
+	for it.Rewind(); it.Valid(); it.Next() {
+		if len(keys)%countCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		keys = append(keys, ds.RawKey(string(it.Item().Key()[len(prefix):])))
+	}
+	return keys, nil
+}
+
+// RebuildIndex removes all the entries of an index, and indexes the entries
+// under its prefix again. It isn't atomic, and must not run concurrently
+// with writes under the prefix.
+func (d *Datastore) RebuildIndex(ctx context.Context, name string) error {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+
+	idx, ok := d.index(name)
+	if !ok {
+		return ErrUnknownIndex
+	}
+
+	wb := d.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := d.DB.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		opt.Prefix = indexPrefix(name)
+		it := txn.NewIterator(opt)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := wb.Delete(it.Item().KeyCopy(nil)); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		it.Close()
+
+		opt = badger.DefaultIteratorOptions
+		opt.Prefix = indexSourcePrefix(idx)
+		it = txn.NewIterator(opt)
+		defer it.Close()
+		n := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			if n%countCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			n++
+
+			item := it.Item()
+			key := ds.RawKey(string(item.Key()))
+			err := item.Value(func(value []byte) error {
+				for _, v := range idx.Extract(key, value) {
+					e := &badger.Entry{
+						Key:       indexKey(name, v, item.Key()),
+						ExpiresAt: item.ExpiresAt(),
+					}
+					if err := wb.SetEntry(e); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+func (d *Datastore) index(name string) (Index, bool) {
+	d.indexLk.RLock()
+	defer d.indexLk.RUnlock()
+	idx, ok := d.indexes[name]
+	return idx, ok
+}
+
+// indexesFor returns the indexes a key is under.
+func (d *Datastore) indexesFor(key ds.Key) []Index {
+	d.indexLk.RLock()
+	defer d.indexLk.RUnlock()
+	if len(d.indexes) == 0 {
+		return nil
+	}
+	var indexes []Index
+	for _, idx := range d.indexes {
+		if strings.HasPrefix(key.String(), string(indexSourcePrefix(idx))) {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// indexSourcePrefix returns the prefix of the keys under an index.
+func indexSourcePrefix(idx Index) []byte {
+	if p := queryPrefix(idx.Prefix.String()); p != nil {
+		return p
+	}
+	return []byte("/")
+}
+
+// indexPrefix returns the prefix of the entries of an index.
+func indexPrefix(name string) []byte {
+	return []byte(indexNamespace + name + "/")
+}
+
+// indexValuePrefix returns the prefix of the entries of an index for a
+// value. Values are prefixed with their length, so that no value is the
+// prefix of another.
+func indexValuePrefix(name string, value []byte) []byte {
+	p := indexPrefix(name)
+	p = binary.AppendUvarint(p, uint64(len(value)))
+	return append(p, value...)
+}
+
+// indexKey returns the key of an index entry, made of the indexed value
+// and the key of the entry it was extracted from.
+func indexKey(name string, value, key []byte) []byte {
+	return append(indexValuePrefix(name, value), key...)
+}
+
+// updateIndexes replaces the index entries of the previous value of a key
+// with the ones of its new value, or removes them if it's being deleted. The
+// new entries expire with the value, at expiresAt unless zero. This includes
+// the expiration index, see Options.ExpirationIndex.
+func (t *txn) updateIndexes(key ds.Key, value []byte, expiresAt uint64, deleted bool) error {
+	indexes := t.ds.indexesFor(key)
+	if len(indexes) == 0 && !t.ds.expirationIndex {
+		return nil
+	}
+
+	k := key.Bytes()
+	var previous [][]byte
+	item, err := t.txn.Get(k)
+	switch err {
+	case nil:
+		if t.ds.expirationIndex && item.ExpiresAt() > 0 {
+			previous = append(previous, expirationKey(item.ExpiresAt(), k))
+		}
+		if len(indexes) == 0 {
+			break
+		}
+		err = item.Value(func(old []byte) error {
+			for _, idx := range indexes {
+				for _, v := range idx.Extract(key, old) {
+					previous = append(previous, indexKey(idx.Name, v, k))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case badger.ErrKeyNotFound:
+	default:
+		return err
+	}
+
+	var current [][]byte
+	if !deleted {
+		if t.ds.expirationIndex && expiresAt > 0 {
+			current = append(current, expirationKey(expiresAt, k))
+		}
+		for _, idx := range indexes {
+			for _, v := range idx.Extract(key, value) {
+				current = append(current, indexKey(idx.Name, v, k))
+			}
+		}
+	}
+
+	for _, ik := range previous {
+		if containsKey(current, ik) {
+			continue
+		}
+		if err := t.txn.Delete(ik); err != nil {
+			return err
+		}
+	}
+	for _, ik := range current {
+		if err := t.txn.SetEntry(&badger.Entry{Key: ik, ExpiresAt: expiresAt}); err != nil {
+			return err
+		}
+		t.churn += int64(len(ik))
+	}
+	return nil
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexOp is a write to an indexed key in a batch.
+type indexOp struct {
+	key    ds.Key
+	value  []byte
+	delete bool
+}
+
+// applyIndexOps applies the writes to indexed keys of a batch, each along
+// with its index entries in the same transaction, in as few transactions as
+// possible.
+func (d *Datastore) applyIndexOps(ops []indexOp) error {
+	for len(ops) > 0 {
+		n, err := d.applyIndexOpsTxn(ops)
+		switch {
+		case err == badger.ErrTxnTooBig && n > 0:
+			// Commit the writes that fit without the one that didn't,
+			// which may be partially applied.
+			if _, err := d.applyIndexOpsTxn(ops[:n]); err != nil {
+				return err
+			}
+		case err == badger.ErrConflict:
+			continue
+		case err != nil:
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// applyIndexOpsTxn applies writes in a single transaction, returning how
+// many it applied before an error.
+func (d *Datastore) applyIndexOpsTxn(ops []indexOp) (int, error) {
+	txn := d.newImplicitTransaction(false)
+	defer txn.discard()
+	for i, op := range ops {
+		var err error
+		if op.delete {
+			err = txn.delete(op.key)
+		} else {
+			err = txn.put(op.key, op.value)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(ops), txn.commit()
+}
@@ -0,0 +1,194 @@
+package badger
+
+import (
+	"bytes"
+	"testing"
+
+	badger "github.com/dgraph-io/badger"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// tagsIndex indexes the entries under /meta by the comma separated tags of
+// their value.
+var tagsIndex = Index{
+	Name:   "tags",
+	Prefix: ds.NewKey("/meta"),
+	Extract: func(key ds.Key, value []byte) [][]byte {
+		if len(value) == 0 {
+			return nil
+		}
+		return bytes.Split(value, []byte(","))
+	},
+}
+
+func expectLookup(t *testing.T, d *Datastore, value string, expected ...string) {
+	t.Helper()
+	keys, err := d.LookupIndex(bg, "tags", []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected %v for %s, got %v", expected, value, keys)
+	}
+	for i, k := range keys {
+		if k.String() != expected[i] {
+			t.Fatalf("expected %v for %s, got %v", expected, value, keys)
+		}
+	}
+}
+
+func TestRegisterIndex(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.RegisterIndex(tagsIndex); err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range []Index{
+		tagsIndex,
+		{Name: "", Extract: tagsIndex.Extract},
+		{Name: "a/b", Extract: tagsIndex.Extract},
+		{Name: "none"},
+	} {
+		if err := d.RegisterIndex(idx); err == nil {
+			t.Fatalf("expected an error registering %q", idx.Name)
+		}
+	}
+	if _, err := d.LookupIndex(bg, "none", nil); err != ErrUnknownIndex {
+		t.Fatalf("expected ErrUnknownIndex, got %v", err)
+	}
+}
+
+func TestIndexWrites(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.RegisterIndex(tagsIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(k, v string) {
+		t.Helper()
+		if err := d.Put(bg, ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("/meta/b", "red,big")
+	put("/meta/a", "red")
+	put("/meta/a/c", "small")
+	put("/other/a", "red")
+	expectLookup(t, d, "red", "/meta/a", "/meta/b")
+	expectLookup(t, d, "big", "/meta/b")
+	expectLookup(t, d, "re")
+
+	// Overwriting and deleting remove the previous entries.
+	put("/meta/b", "blue,big")
+	expectLookup(t, d, "red", "/meta/a")
+	expectLookup(t, d, "blue", "/meta/b")
+	expectLookup(t, d, "big", "/meta/b")
+	if err := d.Delete(bg, ds.NewKey("/meta/b")); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "big")
+
+	// Index entries aren't visible to queries.
+	res, err := d.Query(bg, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/meta/a", "/meta/a/c", "/other/a"}, res)
+
+	// Transactions only update indexes on commit.
+	tx, err := d.NewTransaction(bg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(bg, ds.NewKey("/meta/d"), []byte("green")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(bg, ds.NewKey("/meta/a")); err != nil {
+		t.Fatal(err)
+	}
+	tx.Discard(bg)
+	expectLookup(t, d, "green")
+	expectLookup(t, d, "red", "/meta/a")
+
+	tx, err = d.NewTransaction(bg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(bg, ds.NewKey("/meta/d"), []byte("green")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(bg, ds.NewKey("/meta/d"), []byte("green,red")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(bg); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "green", "/meta/d")
+	expectLookup(t, d, "red", "/meta/a", "/meta/d")
+
+	b, err := d.Batch(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(bg, ds.NewKey("/meta/e"), []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(bg, ds.NewKey("/meta/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(bg, ds.NewKey("/other/b"), []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "red", "/meta/a", "/meta/d")
+	if err := b.Commit(bg); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "red", "/meta/a", "/meta/e")
+	expectLookup(t, d, "green")
+	if _, err := d.Get(bg, ds.NewKey("/other/b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Put(bg, ds.NewKey("/meta/a"), []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RegisterIndex(tagsIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(bg, ds.NewKey("/meta/b"), []byte("red")); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "red", "/meta/b")
+
+	// Leave a stale entry behind.
+	if err := d.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(indexKey("tags", []byte("blue"), []byte("/meta/c")), nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "blue", "/meta/c")
+
+	if err := d.RebuildIndex(bg, "tags"); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, d, "red", "/meta/a", "/meta/b")
+	expectLookup(t, d, "blue")
+}
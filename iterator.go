@@ -0,0 +1,189 @@
+package badger
+
+import (
+	"context"
+	"time"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// IterateOptions configure an Iterator.
+type IterateOptions struct {
+	// ReuseBuffers lets the iterator copy values into the same buffer,
+	// instead of allocating a new one for every entry. The slices returned
+	// by Value are then only valid until the next call to Next.
+	ReuseBuffers bool
+}
+
+// Iterator iterates over the results of a query synchronously, without the
+// goroutine and channel behind dsq.Results. It is not safe for concurrent
+// use.
+//
+// Queries ordered by key, the default, read straight from a badger
+// iterator. Others are run as regular queries.
+//
+//	it, err := d.Iterate(ctx, q, badger.IterateOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		process(it.Key(), it.Value())
+//	}
+//	return it.Err()
+type Iterator struct {
+	ctx   context.Context
+	t     *txn
+	reuse bool
+
+	// Exactly one of qi and res is set.
+	qi  *queryIter
+	res dsq.Results
+
+	entry  dsq.Entry
+	buf    []byte
+	err    error
+	done   bool
+	closed bool
+}
+
+// Iterate returns an iterator over the results of q. The iterator must be
+// closed once done with.
+func (d *Datastore) Iterate(ctx context.Context, q dsq.Query, opts IterateOptions) (*Iterator, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	return d.newImplicitTransaction(true).iterate(ctx, q, opts, d.queryLimits(ctx))
+}
+
+// Iterate returns an iterator over the results of q within the
+// transaction. The iterator must be closed before the transaction is
+// committed or discarded.
+func (t *txn) Iterate(ctx context.Context, q dsq.Query, opts IterateOptions) (*Iterator, error) {
+	t.ds.closeLk.RLock()
+	defer t.ds.closeLk.RUnlock()
+	if t.ds.closed {
+		return nil, ErrClosed
+	}
+
+	return t.iterate(ctx, q, opts, t.ds.queryLimits(ctx))
+}
+
+func (t *txn) iterate(ctx context.Context, q dsq.Query, opts IterateOptions, limits QueryLimits) (*Iterator, error) {
+	it := &Iterator{ctx: ctx, t: t, reuse: opts.ReuseBuffers}
+	if plan := explain(q); !plan.Buffered {
+		it.qi = t.newQueryIter(q, plan, limits)
+		return it, nil
+	}
+
+	res, err := t.query(q, limits)
+	if err != nil {
+		return nil, err
+	}
+	it.res = res
+	return it, nil
+}
+
+// Next advances to the next entry, returning false when there are no more
+// entries or an error occurred, see Err.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		return it.fail(err)
+	}
+
+	var res dsq.Result
+	var ok bool
+	if it.qi != nil {
+		it.t.ds.closeLk.RLock()
+		if it.t.ds.closed {
+			it.t.ds.closeLk.RUnlock()
+			return it.fail(ErrClosed)
+		}
+		var buf []byte
+		if it.reuse {
+			buf = it.buf
+		}
+		res, ok = it.qi.next(buf)
+		it.t.ds.closeLk.RUnlock()
+	} else {
+		res, ok = it.res.NextSync()
+	}
+
+	if !ok {
+		it.done = true
+		return false
+	}
+	if res.Error != nil {
+		return it.fail(res.Error)
+	}
+	it.entry = res.Entry
+	if it.reuse && cap(res.Value) > cap(it.buf) {
+		it.buf = res.Value
+	}
+	return true
+}
+
+func (it *Iterator) fail(err error) bool {
+	it.err = err
+	it.done = true
+	return false
+}
+
+// Key returns the key of the current entry.
+func (it *Iterator) Key() string {
+	return it.entry.Key
+}
+
+// Value returns the value of the current entry, nil for KeysOnly queries.
+func (it *Iterator) Value() []byte {
+	return it.entry.Value
+}
+
+// Size returns the size of the current entry's value.
+func (it *Iterator) Size() int {
+	return it.entry.Size
+}
+
+// Expiration returns the expiration of the current entry, only set for
+// queries with ReturnExpirations.
+func (it *Iterator) Expiration() time.Time {
+	return it.entry.Expiration
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources held by the iterator. It's safe to call it
+// several times.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.done = true
+
+	if it.res != nil {
+		return it.res.Close()
+	}
+
+	it.t.ds.closeLk.RLock()
+	defer it.t.ds.closeLk.RUnlock()
+	if it.t.ds.closed {
+		return nil
+	}
+	it.qi.close()
+	// Iterators created by Datastore.Iterate run in their own
+	// transaction.
+	if it.t.implicit {
+		it.t.discard()
+	}
+	return nil
+}
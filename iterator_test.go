@@ -0,0 +1,141 @@
+package badger
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// iterateKeys drains an iterator, returning the keys it produced.
+func iterateKeys(t *testing.T, it *Iterator) []string {
+	t.Helper()
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestIterate(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	for _, q := range []dsq.Query{
+		{Prefix: "/a"},
+		{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Offset: 1, Limit: 2},
+		{Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.GreaterThan, Value: []byte("ab")}}, Offset: 1},
+		{Orders: []dsq.Order{dsq.OrderByValue{}}, Limit: 4},
+		{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}},
+	} {
+		it, err := d.Iterate(bg, q, IterateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := iterateKeys(t, it)
+
+		res, err := d.Query(bg, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectKeys(t, got, res)
+	}
+
+	// Values are copied unless buffers are reused.
+	it, err := d.Iterate(bg, dsq.Query{Prefix: "/a/b"}, IterateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values [][]byte
+	for it.Next() {
+		values = append(values, it.Value())
+		if it.Size() != len(it.Value()) {
+			t.Fatalf("unexpected size %d for %s", it.Size(), it.Key())
+		}
+	}
+	it.Close()
+	if len(values) != 2 || string(values[0]) != "abc" || string(values[1]) != "a/b/d" {
+		t.Fatalf("unexpected values %q", values)
+	}
+
+	it, err = d.Iterate(bg, dsq.Query{Prefix: "/a"}, IterateOptions{ReuseBuffers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+		if string(it.Value()) != testcases[it.Key()] {
+			t.Fatalf("unexpected value %q for %s", it.Value(), it.Key())
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(bg)
+	cancel()
+	it, err = d.Iterate(ctx, dsq.Query{}, IterateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() || it.Err() != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", it.Err())
+	}
+	it.Close()
+}
+
+func TestIterateTxn(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	tx, err := d.NewTransaction(bg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Discard(bg)
+	if err := tx.Put(bg, ds.NewKey("/a/z"), []byte("az")); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := tx.(*txn).Iterate(bg, dsq.Query{Prefix: "/a", Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/"}}, Limit: 10}, IterateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := iterateKeys(t, it)
+	expected := []string{"/a/b", "/a/b/c", "/a/b/d", "/a/c", "/a/d", "/a/z"}
+	if len(got) != len(expected) || got[len(got)-1] != "/a/z" {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	it, err = d.Iterate(bg, dsq.Query{}, IterateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expected an entry")
+	}
+	d.Close()
+	if it.Next() || it.Err() != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", it.Err())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
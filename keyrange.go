@@ -0,0 +1,238 @@
+package badger
+
+import (
+	"bytes"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// FilterKeyRange is a query filter matching the keys in [Start, End).
+// An empty End leaves the range unbounded above.
+//
+// Queries on a badger Datastore use it to seek straight to the start of the
+// range (or to its end, in descending order) and stop as soon as they leave
+// it, instead of iterating over the whole prefix. Other datastores evaluate
+// it as a regular filter. dsq.FilterKeyPrefix and dsq.FilterKeyCompare
+// (other than NotEqual) are handled the same way.
+type FilterKeyRange struct {
+	Start, End string
+}
+
+var _ dsq.Filter = FilterKeyRange{}
+
+func (f FilterKeyRange) Filter(e dsq.Entry) bool {
+	return e.Key >= f.Start && (f.End == "" || e.Key < f.End)
+}
+
+func (f FilterKeyRange) String() string {
+	if f.End == "" {
+		return fmt.Sprintf("KEY >= %q", f.Start)
+	}
+	return fmt.Sprintf("%q <= KEY < %q", f.Start, f.End)
+}
+
+// keyRange is a range of keys [start, end). A nil start or end leaves the
+// range unbounded on that side.
+type keyRange struct {
+	start, end []byte
+}
+
+// prefixRange returns the range of the keys starting with prefix.
+func prefixRange(prefix []byte) keyRange {
+	if len(prefix) == 0 {
+		return keyRange{}
+	}
+	return keyRange{start: prefix, end: prefixEnd(prefix)}
+}
+
+// prefixEnd returns the smallest key greater than all the keys starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// intersect returns the keys in both r and o.
+func (r keyRange) intersect(o keyRange) keyRange {
+	if o.start != nil && (r.start == nil || bytes.Compare(o.start, r.start) > 0) {
+		r.start = o.start
+	}
+	if o.end != nil && (r.end == nil || bytes.Compare(o.end, r.end) < 0) {
+		r.end = o.end
+	}
+	return r
+}
+
+// empty tells whether no key can fall in r.
+func (r keyRange) empty() bool {
+	return r.start != nil && r.end != nil && bytes.Compare(r.start, r.end) >= 0
+}
+
+// containsSplit tells whether splitting r at key leaves two non-empty
+// ranges.
+func (r keyRange) containsSplit(key []byte) bool {
+	return (r.start == nil || bytes.Compare(key, r.start) > 0) &&
+		(r.end == nil || bytes.Compare(key, r.end) < 0)
+}
+
+// queryRange returns the range of keys a query with the given prefix and
+// filters can match, along with the filters that still need to be evaluated
+// on every entry.
+func queryRange(prefix []byte, filters []dsq.Filter) (keyRange, []dsq.Filter) {
+	// Keys outside of the datastore's namespace, like index entries, sort
+	// before the slash all datastore keys start with.
+	if len(prefix) == 0 {
+		prefix = []byte("/")
+	}
+	r := prefixRange(prefix)
+	var rest []dsq.Filter
+	for _, f := range filters {
+		if fr, ok := filterRange(f); ok {
+			r = r.intersect(fr)
+			continue
+		}
+		// Key patterns narrow the range, but still need to be
+		// evaluated.
+		if p, ok := keyPatternOf(f); ok {
+			r = r.intersect(p.keyRange())
+		}
+		rest = append(rest, f)
+	}
+	return r, rest
+}
+
+// filterRange returns the range of keys matched by a filter on keys, if
+// there is one.
+func filterRange(f dsq.Filter) (keyRange, bool) {
+	switch f := f.(type) {
+	case FilterKeyRange:
+		return keyRange{start: []byte(f.Start), end: nilIfEmpty(f.End)}, true
+	case *FilterKeyRange:
+		return filterRange(*f)
+	case dsq.FilterKeyPrefix:
+		return prefixRange([]byte(f.Prefix)), true
+	case *dsq.FilterKeyPrefix:
+		return filterRange(*f)
+	case dsq.FilterKeyCompare:
+		key := []byte(f.Key)
+		// The smallest key greater than f.Key.
+		after := append(bytes.Clone(key), 0)
+		switch f.Op {
+		case dsq.Equal:
+			return keyRange{start: key, end: after}, true
+		case dsq.GreaterThan:
+			return keyRange{start: after}, true
+		case dsq.GreaterThanOrEqual:
+			return keyRange{start: key}, true
+		case dsq.LessThan:
+			return keyRange{end: key}, true
+		case dsq.LessThanOrEqual:
+			return keyRange{end: after}, true
+		}
+	case *dsq.FilterKeyCompare:
+		return filterRange(*f)
+	}
+	return keyRange{}, false
+}
+
+func nilIfEmpty(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s)
+}
+
+// rangeIterator restricts a badger iterator to a range of keys, seeking to
+// the first key of the range in the iteration order and stopping after the
+// last one.
+type rangeIterator struct {
+	it      *badger.Iterator
+	r       keyRange
+	reverse bool
+
+	// skipped is the range to skip on the next call to next.
+	skipped *keyRange
+	done    bool
+}
+
+// newRangeIterator creates an iterator over the keys in r. The prefix of
+// the options only serves to skip the tables without keys in r.
+func newRangeIterator(txn *badger.Txn, opt badger.IteratorOptions, r keyRange) *rangeIterator {
+	if opt.Reverse {
+		// Seeking in reverse to the end of the range can land on a key
+		// after it, without the prefix, which badger would then consider
+		// the end of the iteration. The range alone bounds it.
+		opt.Prefix = nil
+	}
+	return &rangeIterator{it: txn.NewIterator(opt), r: r, reverse: opt.Reverse}
+}
+
+// rewind positions the iterator on the first key of the range.
+func (ri *rangeIterator) rewind() {
+	if !ri.reverse {
+		ri.it.Seek(ri.r.start)
+		return
+	}
+	if ri.r.end == nil {
+		ri.it.Rewind()
+		return
+	}
+	ri.seekBefore(ri.r.end)
+}
+
+// seekBefore positions the iterator on the last key lower than key, when
+// iterating in reverse.
+func (ri *rangeIterator) seekBefore(key []byte) {
+	// Seeking in reverse finds the last key lower than or equal to key,
+	// which is excluded.
+	ri.it.Seek(key)
+	for ri.it.Valid() && bytes.Compare(ri.it.Item().Key(), key) >= 0 {
+		ri.it.Next()
+	}
+}
+
+func (ri *rangeIterator) valid() bool {
+	if ri.done || ri.r.empty() || !ri.it.Valid() {
+		return false
+	}
+	key := ri.it.Item().Key()
+	if ri.reverse {
+		return ri.r.start == nil || bytes.Compare(key, ri.r.start) >= 0
+	}
+	return ri.r.end == nil || bytes.Compare(key, ri.r.end) < 0
+}
+
+func (ri *rangeIterator) next() {
+	if ri.skipped == nil {
+		ri.it.Next()
+		return
+	}
+	skipped := *ri.skipped
+	ri.skipped = nil
+	switch {
+	case !ri.reverse && skipped.end == nil, ri.reverse && skipped.start == nil:
+		ri.done = true
+	case !ri.reverse:
+		ri.it.Seek(skipped.end)
+	default:
+		ri.seekBefore(skipped.start)
+	}
+}
+
+// skip makes the next call to next seek past the keys in r, which must
+// contain the current key.
+func (ri *rangeIterator) skip(r keyRange) {
+	ri.skipped = &r
+}
+
+func (ri *rangeIterator) item() *badger.Item {
+	return ri.it.Item()
+}
@@ -0,0 +1,258 @@
+package badger
+
+import (
+	"testing"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// expectKeys checks that the results hold exactly the expected keys, in
+// order.
+func expectKeys(t *testing.T, expect []string, res dsq.Results) {
+	t.Helper()
+	actual, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(actual))
+	for i, e := range actual {
+		keys[i] = e.Key
+	}
+	if len(keys) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, keys)
+	}
+	for i := range keys {
+		if keys[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect, keys)
+		}
+	}
+}
+
+func TestQueryKeyRange(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	asc := []dsq.Order{dsq.OrderByKey{}}
+	desc := []dsq.Order{dsq.OrderByKeyDescending{}}
+	for _, tc := range []struct {
+		name   string
+		q      dsq.Query
+		expect []string
+	}{{
+		name:   "ascending",
+		q:      dsq.Query{Filters: []dsq.Filter{FilterKeyRange{Start: "/a/b/d", End: "/e"}}, Orders: asc},
+		expect: []string{"/a/b/d", "/a/c", "/a/d"},
+	}, {
+		name:   "descending",
+		q:      dsq.Query{Filters: []dsq.Filter{FilterKeyRange{Start: "/a/b/d", End: "/e"}}, Orders: desc},
+		expect: []string{"/a/d", "/a/c", "/a/b/d"},
+	}, {
+		name:   "unbounded end",
+		q:      dsq.Query{Filters: []dsq.Filter{FilterKeyRange{Start: "/e"}}, Orders: desc},
+		expect: []string{"/g", "/f", "/e"},
+	}, {
+		name:   "within prefix",
+		q:      dsq.Query{Prefix: "/a", Filters: []dsq.Filter{FilterKeyRange{Start: "/a/b/", End: "/a/d"}}},
+		expect: []string{"/a/b/c", "/a/b/d", "/a/c"},
+	}, {
+		name:   "within prefix descending",
+		q:      dsq.Query{Prefix: "/a", Filters: []dsq.Filter{FilterKeyRange{Start: "/a/b/", End: "/a/d"}}, Orders: desc},
+		expect: []string{"/a/c", "/a/b/d", "/a/b/c"},
+	}, {
+		name:   "prefix descending",
+		q:      dsq.Query{Prefix: "/a", Orders: desc},
+		expect: []string{"/a/d", "/a/c", "/a/b/d", "/a/b/c", "/a/b"},
+	}, {
+		name:   "outside prefix",
+		q:      dsq.Query{Prefix: "/a", Filters: []dsq.Filter{FilterKeyRange{Start: "/b", End: "/f"}}},
+		expect: []string{},
+	}, {
+		name:   "empty",
+		q:      dsq.Query{Filters: []dsq.Filter{FilterKeyRange{Start: "/f", End: "/e"}}, Orders: desc},
+		expect: []string{},
+	}, {
+		name: "offset and limit",
+		q: dsq.Query{
+			Filters: []dsq.Filter{FilterKeyRange{Start: "/a/b", End: "/f"}},
+			Orders:  desc,
+			Offset:  1,
+			Limit:   3,
+		},
+		expect: []string{"/a/d", "/a/c", "/a/b/d"},
+	}, {
+		name: "with other filters",
+		q: dsq.Query{
+			Filters: []dsq.Filter{
+				&FilterKeyRange{Start: "/a/b", End: "/f"},
+				dsq.FilterValueCompare{Op: dsq.NotEqual, Value: []byte("ac")},
+			},
+			Offset: 2,
+		},
+		expect: []string{"/a/b/d", "/a/d", "/e"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.Query(bg, tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeys(t, tc.expect, res)
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, end string
+	}{
+		{"/a/", "/a0"},
+		{"/a\xff", "/b"},
+		{"\xff\xff", ""},
+	} {
+		if end := string(prefixEnd([]byte(tc.prefix))); end != tc.end {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", tc.prefix, end, tc.end)
+		}
+	}
+}
+
+func TestQueryKeyFilters(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	desc := []dsq.Order{dsq.OrderByKeyDescending{}}
+	for _, tc := range []struct {
+		name   string
+		q      dsq.Query
+		expect []string
+	}{{
+		name:   "greater than",
+		q:      dsq.Query{Prefix: "/a", Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/b/c"}}},
+		expect: []string{"/a/b/d", "/a/c", "/a/d"},
+	}, {
+		name:   "greater than or equal",
+		q:      dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThanOrEqual, Key: "/e"}}, Orders: desc},
+		expect: []string{"/g", "/f", "/e"},
+	}, {
+		name:   "less than",
+		q:      dsq.Query{Filters: []dsq.Filter{&dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/a/b/c"}}, Orders: desc},
+		expect: []string{"/a/b", "/a"},
+	}, {
+		name:   "less than or equal",
+		q:      dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.LessThanOrEqual, Key: "/a/b/c"}}},
+		expect: []string{"/a", "/a/b", "/a/b/c"},
+	}, {
+		name:   "equal",
+		q:      dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: "/a/b"}}},
+		expect: []string{"/a/b"},
+	}, {
+		name:   "not equal",
+		q:      dsq.Query{Prefix: "/a/b", Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/b/c"}}},
+		expect: []string{"/a/b/d"},
+	}, {
+		name:   "prefix",
+		q:      dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/b"}}, Orders: desc},
+		expect: []string{"/a/b/d", "/a/b/c", "/a/b"},
+	}, {
+		name: "combined",
+		q: dsq.Query{
+			Prefix: "/a",
+			Filters: []dsq.Filter{
+				&dsq.FilterKeyPrefix{Prefix: "/a/b"},
+				dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/b"},
+				dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/a/b/d"},
+			},
+		},
+		expect: []string{"/a/b/c"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.Query(bg, tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeys(t, tc.expect, res)
+		})
+	}
+}
+
+func TestQueryRangePushdown(t *testing.T) {
+	notEqual := dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a"}
+	value := dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("a")}
+	r, rest := queryRange([]byte("/a/"), []dsq.Filter{
+		dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/b"},
+		notEqual,
+		dsq.FilterKeyPrefix{Prefix: "/a/b"},
+		value,
+	})
+	if string(r.start) != "/a/b\x00" || string(r.end) != "/a/c" {
+		t.Fatalf("unexpected range [%q, %q)", r.start, r.end)
+	}
+	if len(rest) != 2 || rest[0] != notEqual || rest[1].(dsq.FilterValueCompare).Op != value.Op {
+		t.Fatalf("unexpected remaining filters %v", rest)
+	}
+}
+
+func TestQueryDescendingPrefixEnd(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// "/a0" is where seeking in reverse from the end of "/a/" lands.
+	addTestCases(t, d, map[string]string{
+		"/a/x": "x",
+		"/a/y": "y",
+		"/a/m": "m",
+		"/a0":  "0",
+		"/b":   "b",
+	})
+
+	desc := []dsq.Order{dsq.OrderByKeyDescending{}}
+	expected := []string{"/a/y", "/a/x", "/a/m"}
+
+	res, err := d.Query(bg, dsq.Query{Prefix: "/a", Orders: desc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, expected, res)
+
+	res, err = d.Query(bg, dsq.Query{Filters: []dsq.Filter{FilterKeyPattern{Pattern: "/a/*"}}, Orders: desc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, expected, res)
+
+	res, err = d.QueryPrefixes(bg, dsq.Query{Orders: desc}, []string{"/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, expected, res)
+
+	pr, err := d.QueryFrom(bg, dsq.Query{Prefix: "/a", Orders: desc, Limit: 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, expected[:2], pr)
+	pr, err = d.QueryFrom(bg, dsq.Query{Prefix: "/a", Orders: desc, Limit: 2}, pr.Cursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, expected[2:], pr)
+
+	it, err := d.Iterate(bg, dsq.Query{Prefix: "/a", Orders: desc}, IterateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := iterateKeys(t, it); len(keys) != 3 || keys[0] != "/a/y" {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+}
@@ -0,0 +1,127 @@
+package badger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueryLimit is matched, with errors.Is, by the QueryLimitError ending
+// the results of a query that hit one of its limits.
+var ErrQueryLimit = errors.New("query limit reached")
+
+// QueryLimits bound the work done by a query. A zero field leaves the
+// corresponding limit unset.
+//
+// They apply to Query, QueryFrom, QueryPrefixes, QueryParallel,
+// QueryExpiring and Iterate. Results sorted by something else than their key
+// only count the entries scanned before sorting. The workers of a parallel
+// query share the limits, and results sent by other workers may follow the
+// error.
+type QueryLimits struct {
+	// Number of entries examined, whether they pass the filters or not.
+	MaxScanned int
+	// Number of value bytes loaded, including for entries that don't pass
+	// the filters.
+	MaxValueBytes int64
+	// Time since the query started.
+	MaxDuration time.Duration
+}
+
+// QueryLimitError is the error ending the results of a query that hit one
+// of its limits. Entries returned before it are valid, but the results are
+// truncated.
+type QueryLimitError struct {
+	// Limit is the name of the QueryLimits field that was hit.
+	Limit string
+
+	Scanned    int
+	ValueBytes int64
+	Elapsed    time.Duration
+}
+
+func (e *QueryLimitError) Error() string {
+	return fmt.Sprintf("query limit %s reached after scanning %d entries and %d value bytes in %s",
+		e.Limit, e.Scanned, e.ValueBytes, e.Elapsed)
+}
+
+func (e *QueryLimitError) Is(target error) bool {
+	return target == ErrQueryLimit
+}
+
+type queryLimitsKey struct{}
+
+// WithQueryLimits returns a context overriding Options.QueryLimits for the
+// queries it's passed to. Zero fields keep the value from the options,
+// negative ones remove the limit.
+func WithQueryLimits(ctx context.Context, limits QueryLimits) context.Context {
+	return context.WithValue(ctx, queryLimitsKey{}, limits)
+}
+
+// queryLimits returns the limits of a query run with ctx.
+func (d *Datastore) queryLimits(ctx context.Context) QueryLimits {
+	limits := d.defaultQueryLimits
+	override, ok := ctx.Value(queryLimitsKey{}).(QueryLimits)
+	if !ok {
+		return limits
+	}
+	if override.MaxScanned != 0 {
+		limits.MaxScanned = max(override.MaxScanned, 0)
+	}
+	if override.MaxValueBytes != 0 {
+		limits.MaxValueBytes = max(override.MaxValueBytes, 0)
+	}
+	if override.MaxDuration != 0 {
+		limits.MaxDuration = max(override.MaxDuration, 0)
+	}
+	return limits
+}
+
+// queryStats counts the work done by a query. They can be shared by the
+// workers of a parallel query.
+type queryStats struct {
+	start      time.Time
+	scanned    atomic.Int64
+	valueBytes atomic.Int64
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{start: time.Now()}
+}
+
+// scan records that an entry was examined.
+func (s *queryStats) scan() {
+	s.scanned.Add(1)
+}
+
+// loaded records that a value was loaded. It's a no-op on nil stats.
+func (s *queryStats) loaded(size int) {
+	if s != nil {
+		s.valueBytes.Add(int64(size))
+	}
+}
+
+// check returns a QueryLimitError if the stats exceed the limits.
+func (s *queryStats) check(limits QueryLimits) error {
+	limit := ""
+	scanned, valueBytes := int(s.scanned.Load()), s.valueBytes.Load()
+	elapsed := time.Since(s.start)
+	switch {
+	case limits.MaxScanned > 0 && scanned > limits.MaxScanned:
+		limit = "MaxScanned"
+	case limits.MaxValueBytes > 0 && valueBytes > limits.MaxValueBytes:
+		limit = "MaxValueBytes"
+	case limits.MaxDuration > 0 && elapsed > limits.MaxDuration:
+		limit = "MaxDuration"
+	default:
+		return nil
+	}
+	return &QueryLimitError{
+		Limit:      limit,
+		Scanned:    scanned,
+		ValueBytes: valueBytes,
+		Elapsed:    elapsed,
+	}
+}
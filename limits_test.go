@@ -0,0 +1,109 @@
+package badger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// queryUntilError drains the results of a query, returning the keys read
+// before the error ending them.
+func queryUntilError(t *testing.T, d *Datastore, ctx context.Context, q dsq.Query) ([]string, error) {
+	t.Helper()
+	res, err := d.Query(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	var keys []string
+	for r := range res.Next() {
+		if r.Error != nil {
+			return keys, r.Error
+		}
+		keys = append(keys, r.Key)
+	}
+	return keys, nil
+}
+
+func expectLimitError(t *testing.T, err error, limit string) {
+	t.Helper()
+	if !errors.Is(err, ErrQueryLimit) {
+		t.Fatalf("expected ErrQueryLimit, got %v", err)
+	}
+	var lerr *QueryLimitError
+	if !errors.As(err, &lerr) || lerr.Limit != limit {
+		t.Fatalf("expected %s to be hit, got %v", limit, err)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	opts := DefaultOptions
+	opts.QueryLimits.MaxScanned = 3
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addTestCases(t, d, testcases)
+
+	// Queries scanning less entries than the limit aren't affected.
+	keys, err := queryUntilError(t, d, bg, dsq.Query{Prefix: "/a/b"})
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v, %v", keys, err)
+	}
+
+	keys, err = queryUntilError(t, d, bg, dsq.Query{Prefix: "/a"})
+	expectLimitError(t, err, "MaxScanned")
+	if len(keys) != 3 || keys[0] != "/a/b" {
+		t.Fatalf("expected the first 3 keys, got %v", keys)
+	}
+
+	// Entries rejected by filters count too.
+	keys, err = queryUntilError(t, d, bg, dsq.Query{
+		Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a"}},
+		Offset:  1,
+	})
+	expectLimitError(t, err, "MaxScanned")
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %v", keys)
+	}
+
+	// Overrides, negative ones removing the limit.
+	keys, err = queryUntilError(t, d, WithQueryLimits(bg, QueryLimits{MaxScanned: -1}), dsq.Query{})
+	if err != nil || len(keys) != len(testcases) {
+		t.Fatalf("expected all keys, got %v, %v", keys, err)
+	}
+
+	ctx := WithQueryLimits(bg, QueryLimits{MaxScanned: -1, MaxValueBytes: 4})
+	keys, err = queryUntilError(t, d, ctx, dsq.Query{Prefix: "/a"})
+	expectLimitError(t, err, "MaxValueBytes")
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v", keys)
+	}
+
+	// Keys only queries don't load values.
+	keys, err = queryUntilError(t, d, ctx, dsq.Query{Prefix: "/a", KeysOnly: true})
+	if err != nil || len(keys) != 5 {
+		t.Fatalf("expected 5 keys, got %v, %v", keys, err)
+	}
+
+	ctx = WithQueryLimits(bg, QueryLimits{MaxDuration: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	it, err := d.Iterate(ctx, dsq.Query{}, IterateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if it.Next() {
+		t.Fatal("expected no entries")
+	}
+	expectLimitError(t, it.Err(), "MaxDuration")
+
+	// Limits of queries not ordered by key apply before sorting.
+	_, err = queryUntilError(t, d, bg, dsq.Query{Orders: []dsq.Order{dsq.OrderByValue{}}})
+	expectLimitError(t, err, "MaxScanned")
+}
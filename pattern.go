@@ -0,0 +1,150 @@
+package badger
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// FilterKeyPattern is a query filter matching keys against a pattern, with
+// the syntax of path.Match. Wildcards match within a single path segment,
+// so "/providers/*/records/x" matches "/providers/a/records/x" but not
+// "/providers/a/b/records/x" or "/providers/a/records/x/y".
+//
+// Queries on a badger Datastore only iterate over the keys under the
+// segments before the first wildcard, and seek past the subtrees that can't
+// match rather than checking every key in them.
+type FilterKeyPattern struct {
+	Pattern string
+}
+
+var _ dsq.Filter = FilterKeyPattern{}
+
+func (f FilterKeyPattern) Filter(e dsq.Entry) bool {
+	_, ok := compileKeyPattern(f.Pattern).match(e.Key)
+	return ok
+}
+
+func (f FilterKeyPattern) String() string {
+	return fmt.Sprintf("KEY MATCHES %q", f.Pattern)
+}
+
+// keyPattern is a parsed FilterKeyPattern.
+type keyPattern struct {
+	segments []string
+	// literal tells which segments have no wildcard.
+	literal []bool
+}
+
+func compileKeyPattern(pattern string) keyPattern {
+	segments := strings.Split(ds.NewKey(pattern).String()[1:], "/")
+	p := keyPattern{segments: segments, literal: make([]bool, len(segments))}
+	for i, s := range segments {
+		p.literal[i] = !strings.ContainsAny(s, `*?[\`)
+	}
+	return p
+}
+
+// keyPatternOf returns the pattern of a FilterKeyPattern.
+func keyPatternOf(f dsq.Filter) (keyPattern, bool) {
+	switch f := f.(type) {
+	case FilterKeyPattern:
+		return compileKeyPattern(f.Pattern), true
+	case *FilterKeyPattern:
+		return compileKeyPattern(f.Pattern), true
+	}
+	return keyPattern{}, false
+}
+
+// splitPatterns separates the key patterns from the other filters.
+func splitPatterns(filters []dsq.Filter) (patterns []keyPattern, patternFilters, rest []dsq.Filter) {
+	for _, f := range filters {
+		if p, ok := keyPatternOf(f); ok {
+			patterns = append(patterns, p)
+			patternFilters = append(patternFilters, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	return patterns, patternFilters, rest
+}
+
+// keyRange returns the range of the keys under the segments before the
+// first wildcard.
+func (p keyPattern) keyRange() keyRange {
+	prefix := ""
+	for i, s := range p.segments {
+		if !p.literal[i] {
+			return prefixRange([]byte(prefix + "/"))
+		}
+		prefix += "/" + s
+	}
+	// No wildcard, only one key matches.
+	return keyRange{start: []byte(prefix), end: []byte(prefix + "\x00")}
+}
+
+// match tells whether a key matches the pattern. If it doesn't, it also
+// returns a range of keys around it that don't either.
+func (p keyPattern) match(key string) (keyRange, bool) {
+	single := keyRange{start: []byte(key), end: []byte(key + "\x00")}
+
+	// prefix is made of the segments of key matching the pattern so far,
+	// and rest of the ones left, starting with a slash.
+	prefix, rest := "", key
+	for i, segment := range p.segments {
+		if !strings.HasPrefix(rest, "/") {
+			// The key is shorter than the pattern.
+			return single, false
+		}
+		s, _, more := strings.Cut(rest[1:], "/")
+		last := i == len(p.segments)-1
+
+		if p.literal[i] {
+			if s != segment {
+				// Matching keys start with target, seek to them or
+				// past the subtree under prefix if they're behind.
+				target := prefix + "/" + segment
+				if !last {
+					target += "/"
+				}
+				if key < target {
+					return keyRange{start: []byte(prefix + "/"), end: []byte(target)}, false
+				}
+				targetEnd := []byte(target + "\x00")
+				if !last {
+					targetEnd = prefixEnd([]byte(target))
+				}
+				return keyRange{start: targetEnd, end: prefixEnd([]byte(prefix + "/"))}, false
+			}
+		} else if ok, _ := path.Match(segment, s); !ok {
+			if !more {
+				return single, false
+			}
+			// None of the keys under this segment match.
+			return prefixRange([]byte(prefix + "/" + s + "/")), false
+		}
+
+		prefix += "/" + s
+		rest = rest[1+len(s):]
+	}
+	if rest != "" {
+		// The key is longer than the pattern, and so are all the keys
+		// under it.
+		return prefixRange([]byte(prefix + "/")), false
+	}
+	return keyRange{}, true
+}
+
+// matchPatterns tells whether a key matches all the patterns, returning
+// the range of keys to skip if not.
+func matchPatterns(patterns []keyPattern, key string) (keyRange, bool) {
+	for _, p := range patterns {
+		if skip, ok := p.match(key); !ok {
+			return skip, false
+		}
+	}
+	return keyRange{}, true
+}
@@ -0,0 +1,135 @@
+package badger
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// patternTestKeys returns sorted keys with segments of varied lengths, so
+// that sibling segments don't sort like the keys under them.
+func patternTestKeys() []string {
+	var keys []string
+	for _, a := range []string{"providers", "providers-old", "p", "q"} {
+		keys = append(keys, "/"+a)
+		for _, b := range []string{"a", "a-b", "b", "bb"} {
+			keys = append(keys, fmt.Sprintf("/%s/%s", a, b))
+			for _, c := range []string{"meta", "records", "records-x", "z"} {
+				keys = append(keys, fmt.Sprintf("/%s/%s/%s", a, b, c))
+				for _, d := range []string{"1", "2", "2/3"} {
+					keys = append(keys, fmt.Sprintf("/%s/%s/%s/%s", a, b, c, d))
+				}
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var testPatterns = []string{
+	"/providers/*/records/2",
+	"/providers/*/records/*",
+	"/*/b*/records",
+	"/p*/a/*/2/3",
+	"/providers/a-b",
+	"/*",
+	"/q/?/*",
+	"/providers/[ab]/z/1",
+}
+
+func TestKeyPatternMatch(t *testing.T) {
+	keys := patternTestKeys()
+	for _, pattern := range testPatterns {
+		p := compileKeyPattern(pattern)
+		for _, key := range keys {
+			expected, _ := path.Match(pattern, key)
+			skip, ok := p.match(key)
+			if ok != expected {
+				t.Fatalf("%s: expected %s to match: %t", pattern, key, expected)
+			}
+			if ok {
+				continue
+			}
+			// The skipped range must contain the key, and no matching
+			// key.
+			if !rangeContains(skip, key) {
+				t.Fatalf("%s: skipped range [%q, %q) doesn't contain %s", pattern, skip.start, skip.end, key)
+			}
+			for _, other := range keys {
+				if m, _ := path.Match(pattern, other); m && rangeContains(skip, other) {
+					t.Fatalf("%s: skipped range [%q, %q) for %s contains %s", pattern, skip.start, skip.end, key, other)
+				}
+			}
+		}
+	}
+}
+
+func TestQueryKeyPattern(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	keys := patternTestKeys()
+	for _, k := range keys {
+		if err := d.Put(bg, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pattern := range testPatterns {
+		var expected []string
+		for _, k := range keys {
+			if m, _ := path.Match(pattern, k); m {
+				expected = append(expected, k)
+			}
+		}
+
+		for _, reverse := range []bool{false, true} {
+			q := dsq.Query{Filters: []dsq.Filter{FilterKeyPattern{Pattern: pattern}}}
+			exp := expected
+			if reverse {
+				q.Orders = []dsq.Order{dsq.OrderByKeyDescending{}}
+				exp = make([]string, len(expected))
+				for i, k := range expected {
+					exp[len(exp)-1-i] = k
+				}
+			}
+
+			res, err := d.Query(bg, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeys(t, exp, res)
+
+			// Subtrees that can't match are skipped.
+			tx := d.newImplicitTransaction(true)
+			qi := tx.newQueryIter(q, explain(q), QueryLimits{})
+			for {
+				if _, ok := qi.next(nil); !ok {
+					break
+				}
+			}
+			scanned := int(qi.stats.scanned.Load())
+			qi.close()
+			tx.discard()
+			if scanned > len(keys)/4 {
+				t.Errorf("%s: scanned %d keys for %d results", pattern, scanned, len(expected))
+			}
+		}
+	}
+
+	p := d.Explain(dsq.Query{Filters: []dsq.Filter{FilterKeyPattern{Pattern: "/providers/*/records"}}})
+	if p.Start != "/providers/" || p.End != "/providers0" || len(p.PatternFilters) != 1 || len(p.KeyFilters) != 0 {
+		t.Fatalf("unexpected plan %s", p)
+	}
+}
+
+func rangeContains(r keyRange, key string) bool {
+	return (r.start == nil || key >= string(r.start)) && (r.end == nil || key < string(r.end))
+}
@@ -0,0 +1,249 @@
+package badger
+
+import (
+	"context"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func (t *txn) query(q dsq.Query, limits QueryLimits) (dsq.Results, error) {
+	plan := explain(q)
+
+	// Handle ordering
+	if plan.Order == PlanSort {
+		// Ok, we have a weird order we can't handle. Let's
+		// perform the _base_ query (prefix, filter, etc.), then
+		// handle sort/offset/limit later.
+
+		// Skip the stuff we can't apply.
+		baseQuery := q
+		baseQuery.Limit = 0
+		baseQuery.Offset = 0
+		baseQuery.Orders = nil
+
+		// perform the base query, then apply the rest of the query,
+		// sorting on disk what doesn't fit in memory.
+		res := t.iterResults(baseQuery, t.newQueryIter(baseQuery, plan, limits))
+		return t.ds.sortResults(q, res), nil
+	}
+
+	return t.iterResults(q, t.newQueryIter(q, plan, limits)), nil
+}
+
+// resultIter iterates over the results of a query, see queryIter.
+type resultIter interface {
+	next(buf []byte) (dsq.Result, bool)
+	close()
+}
+
+// iterResults returns the results of q from an iterator, closing it once
+// done.
+func (t *txn) iterResults(q dsq.Query, qi resultIter) dsq.Results {
+	return dsq.ResultsWithContext(q, func(ctx context.Context, output chan<- dsq.Result) {
+		t.ds.closeLk.RLock()
+		closedEarly := false
+		defer func() {
+			t.ds.closeLk.RUnlock()
+			if closedEarly {
+				select {
+				case output <- dsq.Result{
+					Error: ErrClosed,
+				}:
+				case <-ctx.Done():
+				}
+			}
+
+		}()
+		if t.ds.closed {
+			closedEarly = true
+			return
+		}
+
+		// this iterator is part of an implicit transaction, so when
+		// we're done we must discard the transaction. It's safe to
+		// discard the txn it because it contains the iterator only.
+		if t.implicit {
+			defer t.discard()
+		}
+
+		defer qi.close()
+
+		for {
+			result, ok := qi.next(nil)
+			if !ok {
+				return
+			}
+
+			select {
+			case output <- result:
+			case <-t.ds.closing: // datastore closing.
+				closedEarly = true
+				return
+			case <-ctx.Done(): // client told us to close early
+				return
+			}
+		}
+	})
+}
+
+// keyOrder tells whether a query is ordered by key, and if so whether in
+// descending order.
+func keyOrder(q dsq.Query) (reverse, ok bool) {
+	if len(q.Orders) == 0 {
+		// We order by key by default.
+		return false, true
+	}
+	switch q.Orders[0].(type) {
+	case dsq.OrderByKey, *dsq.OrderByKey:
+		return false, true
+	case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
+		// Reverse order by key
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// queryIter walks the results of a query ordered by key.
+type queryIter struct {
+	q        dsq.Query
+	it       *rangeIterator
+	patterns []keyPattern
+	filters  queryFilters
+
+	plan   QueryPlan
+	limits QueryLimits
+	stats  *queryStats
+
+	started bool
+	stopped bool
+	skipped int
+	sent    int
+}
+
+// newQueryIter creates an iterator over the results of q, which must be
+// ordered by key. The plan is the one of the query q is the base of, if
+// its results are sorted, and is only used for logging otherwise.
+func (t *txn) newQueryIter(q dsq.Query, plan QueryPlan, limits QueryLimits) *queryIter {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = plan.PrefetchValues
+	opt.Prefix = queryPrefix(q.Prefix)
+	opt.Reverse = plan.Order == PlanReverseScan
+
+	// Seek straight to the keys the query can match, and only evaluate
+	// the filters that can't be expressed as a key range.
+	// Key patterns are matched first, to skip the keys around the ones
+	// that don't.
+	keys, rest := queryRange(opt.Prefix, q.Filters)
+	patterns, _, rest := splitPatterns(rest)
+
+	return &queryIter{
+		q:        q,
+		it:       newRangeIterator(t.txn, opt, keys),
+		patterns: patterns,
+		filters:  splitFilters(rest),
+		plan:     plan,
+		limits:   limits,
+		stats:    newQueryStats(),
+	}
+}
+
+// next returns the next result, copying its value into buf if it's large
+// enough. It returns false once there are no more results.
+func (qi *queryIter) next(buf []byte) (dsq.Result, bool) {
+	if qi.stopped || (qi.q.Limit > 0 && qi.sent >= qi.q.Limit) {
+		return dsq.Result{}, false
+	}
+
+	// All iterators must be started by rewinding.
+	if !qi.started {
+		qi.it.rewind()
+		qi.started = true
+	} else {
+		qi.it.next()
+	}
+
+	for ; qi.it.valid(); qi.it.next() {
+		item := qi.it.item()
+
+		qi.stats.scan()
+		if err := qi.stats.check(qi.limits); err != nil {
+			qi.stopped = true
+			return dsq.Result{Error: err}, true
+		}
+
+		if skip, ok := matchPatterns(qi.patterns, string(item.Key())); !ok {
+			qi.it.skip(skip)
+			continue
+		}
+
+		// skip to the offset
+		if qi.skipped < qi.q.Offset {
+			// On the happy path, we have no filters and we can go
+			// on our way.
+			if qi.filters.empty() {
+				qi.skipped++
+				continue
+			}
+
+			// On the sad path, we need to apply filters before
+			// counting the item as "skipped" as the offset comes
+			// _after_ the filter.
+			matches, err := matchItem(item, qi.q, qi.filters, qi.stats)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			if matches {
+				qi.skipped++
+			}
+			continue
+		}
+
+		result, ok := itemResult(item, qi.q, qi.filters, buf, qi.stats)
+		if !ok {
+			continue
+		}
+		qi.sent++
+		return result, true
+	}
+	return dsq.Result{}, false
+}
+
+func (qi *queryIter) close() {
+	qi.it.it.Close()
+	log.Debugw("query done",
+		"plan", qi.plan,
+		"scanned", qi.stats.scanned.Load(),
+		"valueBytes", qi.stats.valueBytes.Load(),
+		"skipped", qi.skipped,
+		"results", qi.sent,
+		"duration", time.Since(qi.stats.start),
+	)
+}
+
+// queryPrefix returns the prefix of the keys matched by a query prefix, or
+// nil if it matches all keys.
+func queryPrefix(prefix string) []byte {
+	p := ds.NewKey(prefix).String()
+	if p == "/" {
+		return nil
+	}
+	return []byte(p + "/")
+}
+
+// filter returns _true_ if we should filter (skip) the entry
+func filter(filters []dsq.Filter, entry dsq.Entry) bool {
+	for _, f := range filters {
+		if !f.Filter(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func expires(item *badger.Item) time.Time {
+	return time.Unix(int64(item.ExpiresAt()), 0)
+}
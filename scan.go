@@ -0,0 +1,173 @@
+package badger
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// splitRange splits r along the key ranges of the LSM tree tables holding
+// keys under prefix, so that the parts can be scanned in parallel.
+func (d *Datastore) splitRange(prefix []byte, r keyRange) []keyRange {
+	var ranges []keyRange
+	start := r.start
+	for _, split := range d.DB.KeySplits(prefix) {
+		s := []byte(split)
+		if !(keyRange{start: start, end: r.end}).containsSplit(s) {
+			continue
+		}
+		ranges = append(ranges, keyRange{start: start, end: s})
+		start = s
+	}
+	return append(ranges, keyRange{start: start, end: r.end})
+}
+
+// parallelScan calls fn for every range on up to workers goroutines. It
+// stops at the first error, cancelling the context given to the other
+// calls.
+func parallelScan(ctx context.Context, ranges []keyRange, workers int, fn func(context.Context, keyRange) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		lk   sync.Mutex
+		next int
+		err  error
+	)
+	for i := 0; i < min(workers, len(ranges)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lk.Lock()
+				if next == len(ranges) || err != nil {
+					lk.Unlock()
+					return
+				}
+				r := ranges[next]
+				next++
+				lk.Unlock()
+
+				if rangeErr := fn(ctx, r); rangeErr != nil {
+					lk.Lock()
+					if err == nil {
+						err = rangeErr
+						cancel()
+					}
+					lk.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return err
+}
+
+// QueryParallel runs a query over several goroutines, returning results in
+// no particular order. Options.ScanWorkers sets the number of goroutines.
+//
+// Only queries without Orders, Offset and Limit are parallelized, others
+// run as regular queries. The goroutines share the QueryLimits of the query.
+//
+// The keys are split along the key ranges of the LSM tree tables, as
+// badger's Stream framework does. Stream itself isn't used as, in this
+// version of badger, the goroutine producing its key ranges never exits if
+// the iteration is stopped early, e.g. when the results are closed.
+func (d *Datastore) QueryParallel(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	txn := d.newImplicitTransaction(true)
+	if len(q.Orders) > 0 || q.Offset > 0 || q.Limit > 0 {
+		return txn.query(q, d.queryLimits(ctx))
+	}
+	return txn.queryParallel(q, d.queryLimits(ctx)), nil
+}
+
+func (t *txn) queryParallel(q dsq.Query, limits QueryLimits) dsq.Results {
+	prefix := queryPrefix(q.Prefix)
+	keys, rest := queryRange(prefix, q.Filters)
+	filters := splitFilters(rest)
+	stats := newQueryStats()
+
+	return dsq.ResultsWithContext(q, func(ctx context.Context, output chan<- dsq.Result) {
+		t.ds.closeLk.RLock()
+		closedEarly := false
+		defer func() {
+			t.ds.closeLk.RUnlock()
+			if closedEarly {
+				select {
+				case output <- dsq.Result{Error: ErrClosed}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+		if t.ds.closed {
+			closedEarly = true
+			return
+		}
+		defer t.discard()
+
+		if keys.empty() {
+			return
+		}
+		err := parallelScan(ctx, t.ds.splitRange(prefix, keys), t.ds.scanWorkers, func(ctx context.Context, r keyRange) error {
+			return t.scanRange(ctx, prefix, r, q, filters, limits, stats, output)
+		})
+		log.Debugw("parallel query done",
+			"scanned", stats.scanned.Load(),
+			"valueBytes", stats.valueBytes.Load(),
+			"duration", time.Since(stats.start),
+		)
+		switch {
+		case err == ErrClosed:
+			closedEarly = true
+		case err != nil && ctx.Err() == nil:
+			select {
+			case output <- dsq.Result{Error: err}:
+			case <-ctx.Done():
+			}
+		}
+	})
+}
+
+// scanRange sends the entries in r matching the filters, recording its work
+// in stats and returning a QueryLimitError once they exceed the limits.
+func (t *txn) scanRange(ctx context.Context, prefix []byte, r keyRange, q dsq.Query, filters queryFilters, limits QueryLimits, stats *queryStats, output chan<- dsq.Result) error {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = !q.KeysOnly
+	opt.Prefix = prefix
+	it := newRangeIterator(t.txn, opt, r)
+	defer it.it.Close()
+
+	for it.rewind(); it.valid(); it.next() {
+		stats.scan()
+		if err := stats.check(limits); err != nil {
+			return err
+		}
+
+		result, ok := itemResult(it.item(), q, filters, nil, stats)
+		if !ok {
+			continue
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+
+		select {
+		case output <- result:
+		case <-t.ds.closing: // datastore closing.
+			return ErrClosed
+		case <-ctx.Done(): // client told us to close early
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package badger
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	badger "github.com/dgraph-io/badger"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// newParallelTestDatastore returns a datastore with count keys under /scan,
+// spread over enough tables for scans to be split.
+func newParallelTestDatastore(t *testing.T, count int) (*Datastore, []byte) {
+	opts := DefaultOptions
+	opts.Options = badger.DefaultOptions("")
+	opts.MaxTableSize = 1 << 16
+	opts.ScanWorkers = 4
+	d, err := NewDatastore(t.TempDir(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	value := make([]byte, 100)
+	for i := 0; i < count; i++ {
+		if err := d.Put(bg, ds.NewKey(fmt.Sprintf("/scan/%05d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the memtables to be flushed, so that there are tables to
+	// split the scan along.
+	for i := 0; len(d.DB.KeySplits([]byte("/scan/"))) < 2; i++ {
+		if i == 100 {
+			t.Fatal("memtables weren't flushed")
+		}
+		if err := d.Put(bg, ds.NewKey("/other"), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, _ := queryRange(queryPrefix("/scan"), nil)
+	if ranges := d.splitRange(queryPrefix("/scan"), keys); len(ranges) < 2 {
+		t.Fatalf("expected the scan to be split, got %d ranges", len(ranges))
+	}
+	return d, value
+}
+
+func TestQueryParallel(t *testing.T) {
+	d, value := newParallelTestDatastore(t, 5000)
+
+	res, err := d.QueryParallel(bg, dsq.Query{Prefix: "/scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 5000 {
+		t.Fatalf("expected 5000 entries, got %d", len(es))
+	}
+	keys := make([]string, len(es))
+	for i, e := range es {
+		if len(e.Value) != len(value) {
+			t.Fatalf("unexpected value for %s", e.Key)
+		}
+		keys[i] = e.Key
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if k != fmt.Sprintf("/scan/%05d", i) {
+			t.Fatalf("unexpected key %s", k)
+		}
+	}
+
+	res, err = d.QueryParallel(bg, dsq.Query{
+		Prefix:   "/scan",
+		KeysOnly: true,
+		Filters:  []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.LessThan, Key: "/scan/00100"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err = res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 100 {
+		t.Fatalf("expected 100 entries, got %d", len(es))
+	}
+
+	// The goroutines share the limits.
+	ctx := WithQueryLimits(bg, QueryLimits{MaxScanned: 100})
+	res, err = d.QueryParallel(ctx, dsq.Query{Prefix: "/scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err = res.Rest()
+	expectLimitError(t, err, "MaxScanned")
+	if len(es) > 100 {
+		t.Fatalf("expected at most 100 entries, got %d", len(es))
+	}
+
+	ctx = WithQueryLimits(bg, QueryLimits{MaxValueBytes: 1000})
+	res, err = d.QueryParallel(ctx, dsq.Query{Prefix: "/scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = res.Rest()
+	expectLimitError(t, err, "MaxValueBytes")
+
+	// Ordered queries aren't parallelized.
+	res, err = d.QueryParallel(bg, dsq.Query{Prefix: "/scan", Limit: 3, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, []string{"/scan/04999", "/scan/04998", "/scan/04997"}, res)
+
+	// Closing the results early stops the scan.
+	res, err = d.QueryParallel(bg, dsq.Query{Prefix: "/scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.NextSync(); !ok {
+		t.Fatal("expected a result")
+	}
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
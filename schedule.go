@@ -0,0 +1,238 @@
+package badger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GCSchedule restricts the periodic GC to maintenance windows.
+type GCSchedule interface {
+	// Next returns the window containing t or, if t falls outside of all
+	// windows, the next one to open. It returns zero times if there is no
+	// such window.
+	Next(t time.Time) (start, end time.Time)
+}
+
+// ParseGCSchedule parses a GC maintenance window. Two forms are supported:
+//
+//   - A daily window in local time, e.g. "01:00-05:00". Windows ending
+//     before they start wrap around midnight, e.g. "22:00-02:00".
+//   - A cron expression giving the times at which the window opens,
+//     followed by how long it stays open, e.g. "0 1 * * 1-5 4h" for four
+//     hours from 01:00 on weekdays.
+func ParseGCSchedule(spec string) (GCSchedule, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		return parseDailyWindow(fields[0])
+	case 6:
+		return parseCronWindow(fields)
+	default:
+		return nil, fmt.Errorf("invalid GC schedule %q: expected \"HH:MM-HH:MM\" or a cron expression followed by a duration", spec)
+	}
+}
+
+// dailyWindow is a window open at the same local time every day. Its bounds
+// are wall clock times, so that it follows daylight saving time changes.
+type dailyWindow struct {
+	startHour, startMinute int
+	endHour, endMinute     int
+}
+
+func parseDailyWindow(spec string) (dailyWindow, error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return dailyWindow{}, fmt.Errorf("invalid GC window %q: expected HH:MM-HH:MM", spec)
+	}
+	startHour, startMinute, err := parseTimeOfDay(from)
+	if err != nil {
+		return dailyWindow{}, fmt.Errorf("invalid GC window %q: %w", spec, err)
+	}
+	endHour, endMinute, err := parseTimeOfDay(to)
+	if err != nil {
+		return dailyWindow{}, fmt.Errorf("invalid GC window %q: %w", spec, err)
+	}
+	if startHour == endHour && startMinute == endMinute {
+		return dailyWindow{}, fmt.Errorf("invalid GC window %q: window is empty", spec)
+	}
+	return dailyWindow{
+		startHour:   startHour,
+		startMinute: startMinute,
+		endHour:     endHour,
+		endMinute:   endMinute,
+	}, nil
+}
+
+func parseTimeOfDay(s string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// wraps tells whether the window ends on the day after it starts.
+func (w dailyWindow) wraps() bool {
+	return w.endHour*60+w.endMinute < w.startHour*60+w.startMinute
+}
+
+func (w dailyWindow) Next(t time.Time) (time.Time, time.Time) {
+	// Yesterday's window may still be open if it wraps around midnight.
+	y, m, d := t.Date()
+	for day := d - 1; day <= d+1; day++ {
+		endDay := day
+		if w.wraps() {
+			endDay++
+		}
+		start := time.Date(y, m, day, w.startHour, w.startMinute, 0, 0, t.Location())
+		end := time.Date(y, m, endDay, w.endHour, w.endMinute, 0, 0, t.Location())
+		if end.After(t) {
+			return start, end
+		}
+	}
+	// Unreachable, tomorrow's window always ends after t.
+	return time.Time{}, time.Time{}
+}
+
+// cronWindow is a window opening at the times matched by a cron expression
+// and staying open for a fixed duration.
+type cronWindow struct {
+	minute, hour, dom, month, dow uint64 // bitsets
+
+	// Whether the day of month or week fields are restricted, in which case
+	// a day matches if either of them does, as in cron.
+	domRestricted, dowRestricted bool
+
+	length time.Duration
+}
+
+// cronSearchLimit bounds the search for the next matching time, so that
+// expressions that never match (e.g. February 30th) don't loop forever.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+func parseCronWindow(fields []string) (*cronWindow, error) {
+	spec := strings.Join(fields, " ")
+	length, err := time.ParseDuration(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid GC schedule %q: %w", spec, err)
+	}
+	if length <= 0 {
+		return nil, fmt.Errorf("invalid GC schedule %q: window length must be positive", spec)
+	}
+
+	c := &cronWindow{length: length}
+	parsers := []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, p := range parsers {
+		*p.field, err = parseCronField(fields[i], p.min, p.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GC schedule %q: %w", spec, err)
+		}
+	}
+	// Both 0 and 7 are Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domRestricted = fields[2] != "*"
+	c.dowRestricted = fields[4] != "*"
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of "*", "N" or "N-M", each
+// optionally followed by "/step", into a bitset.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronWindow) Next(t time.Time) (time.Time, time.Time) {
+	// A window containing t opened less than c.length ago.
+	start := c.match(t.Add(-c.length))
+	for !start.IsZero() && !start.Add(c.length).After(t) {
+		start = c.match(start.Add(time.Minute))
+	}
+	if start.IsZero() {
+		return time.Time{}, time.Time{}
+	}
+	return start, start.Add(c.length)
+}
+
+// match returns the first time at or after t matched by the cron expression.
+func (c *cronWindow) match(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	if truncated := t.Truncate(time.Minute); truncated.Before(t) {
+		t = truncated.Add(time.Minute)
+	}
+
+	for t.Before(limit) {
+		y, mon, d := t.Date()
+		loc := t.Location()
+		switch {
+		case c.month&(1<<uint(mon)) == 0:
+			t = time.Date(y, mon+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, mon, d+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, mon, d, t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronWindow) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
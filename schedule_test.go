@@ -0,0 +1,111 @@
+package badger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGCScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"01:00",
+		"01:00-01:00",
+		"25:00-02:00",
+		"0 1 * * *",
+		"0 1 * * * -1h",
+		"60 1 * * * 1h",
+		"0 1 32 * * 1h",
+		"0 5-1 * * * 1h",
+		"*/0 * * * * 1h",
+	} {
+		if _, err := ParseGCSchedule(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	for _, tc := range []struct {
+		spec       string
+		now        string
+		start, end string
+	}{
+		// Daily windows.
+		{"01:00-05:00", "2024-03-04 00:30", "2024-03-04 01:00", "2024-03-04 05:00"},
+		{"01:00-05:00", "2024-03-04 03:00", "2024-03-04 01:00", "2024-03-04 05:00"},
+		{"01:00-05:00", "2024-03-04 05:00", "2024-03-05 01:00", "2024-03-05 05:00"},
+		{"22:00-02:00", "2024-03-04 01:00", "2024-03-03 22:00", "2024-03-04 02:00"},
+		{"22:00-02:00", "2024-03-04 12:00", "2024-03-04 22:00", "2024-03-05 02:00"},
+		// 2024-03-04 is a Monday.
+		{"0 1 * * 1-5 4h", "2024-03-04 00:30", "2024-03-04 01:00", "2024-03-04 05:00"},
+		{"0 1 * * 1-5 4h", "2024-03-04 02:00", "2024-03-04 01:00", "2024-03-04 05:00"},
+		{"0 1 * * 1-5 4h", "2024-03-08 06:00", "2024-03-11 01:00", "2024-03-11 05:00"},
+		{"30 */6 * * * 1h", "2024-03-04 07:00", "2024-03-04 06:30", "2024-03-04 07:30"},
+		{"0 0 1 * 0 1h", "2024-03-04 07:00", "2024-03-10 00:00", "2024-03-10 01:00"},
+		{"0 0 1,15 2 * 1h", "2024-03-04 07:00", "2025-02-01 00:00", "2025-02-01 01:00"},
+	} {
+		sched, err := ParseGCSchedule(tc.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.spec, err)
+		}
+		start, end := sched.Next(at(tc.now))
+		if !start.Equal(at(tc.start)) || !end.Equal(at(tc.end)) {
+			t.Errorf("%q at %s: expected window %s - %s, got %s - %s",
+				tc.spec, tc.now, tc.start, tc.end, start, end)
+		}
+	}
+}
+
+func TestDailyWindowDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	sched, err := ParseGCSchedule("03:00-05:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clocks move forward at 02:00 on 2026-03-08, and back at 02:00 on
+	// 2026-11-01.
+	for _, day := range []time.Time{
+		time.Date(2026, time.March, 8, 0, 0, 0, 0, loc),
+		time.Date(2026, time.November, 1, 0, 0, 0, 0, loc),
+	} {
+		y, m, d := day.Date()
+		start, end := sched.Next(day.Add(30 * time.Minute))
+		expectedStart := time.Date(y, m, d, 3, 0, 0, 0, loc)
+		expectedEnd := time.Date(y, m, d, 5, 0, 0, 0, loc)
+		if !start.Equal(expectedStart) || !end.Equal(expectedEnd) {
+			t.Errorf("expected window %s - %s, got %s - %s", expectedStart, expectedEnd, start, end)
+		}
+	}
+
+	// Windows wrapping around midnight too.
+	sched, err = ParseGCSchedule("22:00-04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := sched.Next(time.Date(2026, time.March, 7, 23, 0, 0, 0, loc))
+	if !start.Equal(time.Date(2026, time.March, 7, 22, 0, 0, 0, loc)) || !end.Equal(time.Date(2026, time.March, 8, 4, 0, 0, 0, loc)) {
+		t.Errorf("unexpected window %s - %s", start, end)
+	}
+}
+
+func TestScheduleNeverMatches(t *testing.T) {
+	sched, err := ParseGCSchedule("0 0 30 2 * 1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, _ := sched.Next(time.Now()); !start.IsZero() {
+		t.Fatalf("expected no window, got %s", start)
+	}
+}
@@ -0,0 +1,166 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// QueryPrefixes runs q over the union of the keys under each of the
+// prefixes, in place of q.Prefix. Results are ordered as requested by q,
+// with Offset and Limit applying to the whole union.
+//
+// Every prefix is read with its own iterator, one after the other, in a
+// single transaction. Prefixes nested in others are skipped, their keys
+// being matched already. The keys under the remaining prefixes don't
+// interleave, so reading the prefixes in key order yields the union in key
+// order.
+func (d *Datastore) QueryPrefixes(ctx context.Context, q dsq.Query, prefixes []string) (dsq.Results, error) {
+	d.closeLk.RLock()
+	defer d.closeLk.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	txn := d.newImplicitTransaction(true)
+	return txn.queryPrefixes(q, prefixes, d.queryLimits(ctx)), nil
+}
+
+func (t *txn) queryPrefixes(q dsq.Query, prefixes []string, limits QueryLimits) dsq.Results {
+	prefixes = unionPrefixes(prefixes)
+
+	if _, ok := keyOrder(q); !ok {
+		// Merge the base queries in key order, then sort.
+		baseQuery := q
+		baseQuery.Limit = 0
+		baseQuery.Offset = 0
+		baseQuery.Orders = nil
+
+		res := t.iterResults(baseQuery, t.newUnionIter(baseQuery, prefixes, limits))
+		return t.ds.sortResults(q, res)
+	}
+
+	return t.iterResults(q, t.newUnionIter(q, prefixes, limits))
+}
+
+// unionPrefixes returns the distinct query prefixes not nested in others,
+// in the order of the keys under them.
+func unionPrefixes(prefixes []string) []string {
+	keys := make([]ds.Key, 0, len(prefixes))
+	for _, p := range prefixes {
+		keys = append(keys, ds.NewKey(p))
+	}
+	// Ancestors are shorter than their descendants.
+	slices.SortFunc(keys, func(a, b ds.Key) int {
+		return len(a.String()) - len(b.String())
+	})
+
+	seen := make(map[string]struct{}, len(keys))
+	var union []string
+	for _, k := range keys {
+		nested := false
+		for a := k; ; a = a.Parent() {
+			if _, ok := seen[a.String()]; ok {
+				nested = true
+				break
+			}
+			if a.String() == "/" {
+				break
+			}
+		}
+		if nested {
+			continue
+		}
+		seen[k.String()] = struct{}{}
+		union = append(union, k.String())
+	}
+
+	// Sort by the keys the prefixes match, which isn't the order of the
+	// prefixes themselves: "/a-b/..." comes before "/a/...".
+	slices.SortFunc(union, func(a, b string) int {
+		return bytes.Compare(queryPrefix(a), queryPrefix(b))
+	})
+	return union
+}
+
+// unionIter walks the results of a query over several prefixes, opening
+// an iterator for each prefix once done with the previous one.
+type unionIter struct {
+	t        *txn
+	q        dsq.Query
+	prefixes []string
+	limits   QueryLimits
+	stats    *queryStats
+
+	qi      *queryIter
+	stopped bool
+	skipped int
+	sent    int
+}
+
+func (t *txn) newUnionIter(q dsq.Query, prefixes []string, limits QueryLimits) *unionIter {
+	if reverse, _ := keyOrder(q); reverse {
+		prefixes = slices.Clone(prefixes)
+		slices.Reverse(prefixes)
+	}
+	return &unionIter{
+		t:        t,
+		q:        q,
+		prefixes: prefixes,
+		limits:   limits,
+		stats:    newQueryStats(),
+	}
+}
+
+func (u *unionIter) next(buf []byte) (dsq.Result, bool) {
+	for !u.stopped && (u.q.Limit <= 0 || u.sent < u.q.Limit) {
+		if u.qi == nil {
+			if len(u.prefixes) == 0 {
+				break
+			}
+			// Pass on what remains of the offset and limit, so that
+			// skipped entries are skipped without loading them.
+			q := u.q
+			q.Prefix = u.prefixes[0]
+			q.Offset = u.q.Offset - u.skipped
+			if u.q.Limit > 0 {
+				q.Limit = u.q.Limit - u.sent
+			}
+			u.prefixes = u.prefixes[1:]
+
+			u.qi = u.t.newQueryIter(q, explain(q), u.limits)
+			u.qi.stats = u.stats
+		}
+
+		result, ok := u.qi.next(buf)
+		if ok {
+			if result.Error == nil {
+				u.sent++
+			}
+			u.stopped = u.qi.stopped
+			return result, true
+		}
+		u.skipped += u.qi.skipped
+		u.qi.it.it.Close()
+		u.qi = nil
+	}
+	return dsq.Result{}, false
+}
+
+func (u *unionIter) close() {
+	if u.qi != nil {
+		u.skipped += u.qi.skipped
+		u.qi.it.it.Close()
+	}
+	log.Debugw("union query done",
+		"scanned", u.stats.scanned.Load(),
+		"valueBytes", u.stats.valueBytes.Load(),
+		"skipped", u.skipped,
+		"results", u.sent,
+		"duration", time.Since(u.stats.start),
+	)
+}
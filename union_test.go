@@ -0,0 +1,91 @@
+package badger
+
+import (
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestUnionPrefixes(t *testing.T) {
+	got := unionPrefixes([]string{"/a/b", "/a-b", "a", "/c/d/e", "/c", "/a/", "/e/f"})
+	expected := []string{"/a-b", "/a", "/c", "/e/f"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+
+	if got := unionPrefixes([]string{"/a", "/", "/b"}); len(got) != 1 || got[0] != "/" {
+		t.Fatalf("expected [/], got %v", got)
+	}
+}
+
+func TestQueryPrefixes(t *testing.T) {
+	d, err := NewDatastore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, k := range []string{
+		"/pins/direct/1", "/pins/direct/3",
+		"/pins/recursive/2", "/pins/recursive/4",
+		"/pins/recursive-old/5", "/pins/other/6", "/pins/direct",
+	} {
+		if err := d.Put(bg, ds.NewKey(k), []byte(k[len(k)-1:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefixes := []string{"/pins/recursive", "/pins/direct", "/pins/recursive-old", "/pins/direct/3"}
+	for _, tc := range []struct {
+		q        dsq.Query
+		expected []string
+	}{{
+		dsq.Query{},
+		[]string{"/pins/direct/1", "/pins/direct/3", "/pins/recursive-old/5", "/pins/recursive/2", "/pins/recursive/4"},
+	}, {
+		dsq.Query{Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+		[]string{"/pins/recursive/4", "/pins/recursive/2", "/pins/recursive-old/5", "/pins/direct/3", "/pins/direct/1"},
+	}, {
+		dsq.Query{Offset: 1, Limit: 3, KeysOnly: true},
+		[]string{"/pins/direct/3", "/pins/recursive-old/5", "/pins/recursive/2"},
+	}, {
+		dsq.Query{Offset: 3, Limit: 1, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+		[]string{"/pins/direct/3"},
+	}, {
+		dsq.Query{Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.GreaterThan, Value: []byte("2")}}, Offset: 1},
+		[]string{"/pins/recursive-old/5", "/pins/recursive/4"},
+	}, {
+		dsq.Query{Orders: []dsq.Order{dsq.OrderByValueDescending{}}, Offset: 1, Limit: 2},
+		[]string{"/pins/recursive/4", "/pins/direct/3"},
+	}} {
+		res, err := d.QueryPrefixes(bg, tc.q, prefixes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectKeys(t, tc.expected, res)
+	}
+
+	res, err := d.QueryPrefixes(bg, dsq.Query{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, nil, res)
+
+	// Limits apply to the whole union.
+	ctx := WithQueryLimits(bg, QueryLimits{MaxScanned: 3})
+	res, err = d.QueryPrefixes(ctx, dsq.Query{}, prefixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if !errors.Is(err, ErrQueryLimit) || len(entries) != 3 {
+		t.Fatalf("expected 3 entries and a limit error, got %v, %v", entries, err)
+	}
+}